@@ -0,0 +1,94 @@
+package acmedns
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+)
+
+// checkAllowFrom returns an error if the address ACME-DNS checks is not
+// within the account's AllowFrom ranges. That is ForwardedForValue if
+// set, as sent in the forwarded-for header, and otherwise the egress IP
+// address used to reach the server of acc.
+func (p *Provider) checkAllowFrom(ctx context.Context, acc account) error {
+	if len(acc.AllowFrom) == 0 {
+		return nil
+	}
+	networks := make([]*net.IPNet, 0, len(acc.AllowFrom))
+	for _, cidr := range acc.AllowFrom {
+		_, network, err := net.ParseCIDR(strings.TrimSpace(cidr))
+		if err != nil {
+			return fmt.Errorf("Error while parsing allowfrom range of domain %s: %w", acc.Domain, err)
+		}
+		networks = append(networks, network)
+	}
+	source, ips, err := p.allowFromIPs(ctx, acc)
+	if err != nil {
+		return err
+	}
+	// Like ACME-DNS, accept a forwarded-for list if any of its
+	// addresses is allowed.
+	for _, ip := range ips {
+		for _, network := range networks {
+			if network.Contains(ip) {
+				return nil
+			}
+		}
+	}
+	addresses := make([]string, 0, len(ips))
+	for _, ip := range ips {
+		addresses = append(addresses, ip.String())
+	}
+	return fmt.Errorf("%s %s is not allowed to update domain %s, allowed ranges: %s",
+		source, strings.Join(addresses, ", "), acc.Domain, strings.Join(acc.AllowFrom, ", "))
+}
+
+// allowFromIPs returns the addresses checked by checkAllowFrom and
+// a description of where they come from.
+func (p *Provider) allowFromIPs(ctx context.Context, acc account) (string, []net.IP, error) {
+	if p.ForwardedForValue != "" {
+		var ips []net.IP
+		for _, address := range strings.Split(p.ForwardedForValue, ",") {
+			ip := net.ParseIP(strings.TrimSpace(address))
+			if ip == nil {
+				return "", nil, fmt.Errorf("ForwardedForValue %q is not a list of IP addresses", p.ForwardedForValue)
+			}
+			ips = append(ips, ip)
+		}
+		return "Forwarded IP address", ips, nil
+	}
+	egressIP := p.EgressIP
+	if egressIP == nil {
+		egressIP = defaultEgressIP
+	}
+	ip, err := egressIP(ctx, acc.ServerURL)
+	if err != nil {
+		return "", nil, fmt.Errorf("Error while determining egress IP address: %w", err)
+	}
+	return "Egress IP address", []net.IP{ip}, nil
+}
+
+// defaultEgressIP returns the local address of a UDP socket connected to
+// the host of serverURL. Connecting a UDP socket sends no packets.
+func defaultEgressIP(ctx context.Context, serverURL string) (net.IP, error) {
+	u, err := url.Parse(serverURL)
+	if err != nil {
+		return nil, fmt.Errorf("Error while parsing server URL: %w", err)
+	}
+	port := u.Port()
+	if port == "" {
+		port = "443"
+		if u.Scheme == "http" {
+			port = "80"
+		}
+	}
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "udp", net.JoinHostPort(u.Hostname(), port))
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	return conn.LocalAddr().(*net.UDPAddr).IP, nil
+}
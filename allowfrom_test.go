@@ -0,0 +1,103 @@
+package acmedns
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/libdns/libdns"
+)
+
+func staticEgressIP(ip string) func(context.Context, string) (net.IP, error) {
+	return func(ctx context.Context, serverURL string) (net.IP, error) {
+		return net.ParseIP(ip), nil
+	}
+}
+
+func TestCheckAllowFrom(t *testing.T) {
+	tests := []struct {
+		egressIP string
+		allowed  bool
+	}{
+		{egressIP: "192.0.2.10", allowed: true},
+		{egressIP: "2001:db8::1", allowed: true},
+		{egressIP: "198.51.100.1", allowed: false},
+	}
+	for _, test := range tests {
+		srv := newMockServer(t)
+		config := srv.newDomainConfig()
+		config.AllowFrom = []string{"192.0.2.0/24", "2001:db8::/32"}
+		p := Provider{
+			Configs:        map[string]DomainConfig{"example.com": config},
+			CheckAllowFrom: true,
+			EgressIP:       staticEgressIP(test.egressIP),
+		}
+		_, err := p.AppendRecords(context.TODO(), "example.com", []libdns.Record{makeRecord("value")})
+		if test.allowed {
+			if err != nil {
+				t.Fatalf("Failed to append record from %s: %v", test.egressIP, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), test.egressIP) {
+			t.Fatalf("Expected an error naming egress IP %s, got %v", test.egressIP, err)
+		}
+		if len(srv.requests) != 0 {
+			t.Fatalf("Expected no requests from %s, got %d", test.egressIP, len(srv.requests))
+		}
+	}
+}
+
+func TestCheckAllowFromWithoutRanges(t *testing.T) {
+	srv := newMockServer(t)
+	p := Provider{
+		Configs:        map[string]DomainConfig{"example.com": srv.newDomainConfig()},
+		CheckAllowFrom: true,
+		EgressIP:       staticEgressIP("198.51.100.1"),
+	}
+	_, err := p.AppendRecords(context.TODO(), "example.com", []libdns.Record{makeRecord("value")})
+	if err != nil {
+		t.Fatal("Failed to append record for an account without allowfrom: ", err)
+	}
+}
+
+func TestCheckAllowFromForwardedFor(t *testing.T) {
+	tests := []struct {
+		forwardedFor string
+		allowed      bool
+	}{
+		{forwardedFor: "198.51.100.7", allowed: true},
+		{forwardedFor: "203.0.113.1, 198.51.100.7", allowed: true},
+		{forwardedFor: "203.0.113.1", allowed: false},
+		{forwardedFor: "not-an-ip", allowed: false},
+	}
+	for _, test := range tests {
+		srv := newMockServer(t)
+		config := srv.newDomainConfig()
+		config.AllowFrom = []string{"198.51.100.0/24"}
+		p := Provider{
+			Configs:           map[string]DomainConfig{"example.com": config},
+			CheckAllowFrom:    true,
+			ForwardedForValue: test.forwardedFor,
+			EgressIP:          staticEgressIP("127.0.0.1"),
+		}
+		_, err := p.AppendRecords(context.TODO(), "example.com", []libdns.Record{makeRecord("value")})
+		if (err == nil) != test.allowed {
+			t.Fatalf("Forwarded for %q: unexpected result %v", test.forwardedFor, err)
+		}
+		if err != nil && strings.Contains(err.Error(), "127.0.0.1") {
+			t.Fatalf("Forwarded for %q: egress IP must not be checked, got %v", test.forwardedFor, err)
+		}
+	}
+}
+
+func TestDefaultEgressIP(t *testing.T) {
+	ip, err := defaultEgressIP(context.TODO(), "http://127.0.0.1:8080")
+	if err != nil {
+		t.Fatal("Failed to determine egress IP: ", err)
+	}
+	if !ip.IsLoopback() {
+		t.Fatalf("Expected a loopback egress IP, got %s", ip)
+	}
+}
@@ -0,0 +1,114 @@
+package acmedns
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/libdns/libdns"
+)
+
+// appendItem is a record of an AppendRecords call with its account.
+type appendItem struct {
+	index  int // position among records to append
+	record libdns.Record
+	value  string // trimmed TXT value
+	name   string // normalized record name, without trailing dot
+	acc    account
+}
+
+// prepareAppend validates records and selects their accounts. If
+// VerifyAfterUpdate is set, it also checks that the updated values can
+// be verified.
+func (p *Provider) prepareAppend(zone string, recs []libdns.Record) ([]appendItem, error) {
+	items := make([]appendItem, 0, len(recs))
+	accounts := map[string]*account{}
+	for _, record := range recs {
+		if record.Type != "TXT" && p.SkipNonTXT {
+			continue
+		}
+		if record.Type != "TXT" {
+			return nil, withCode(CodeBadTXT, fmt.Errorf("joohoi_acme_dns provider only supports adding TXT records"))
+		}
+		value := strings.TrimSpace(record.Value)
+		if p.StrictTXTValidation && len(value) != challengeLength {
+			return nil, withCode(CodeBadTXT, fmt.Errorf("TXT value must be %d characters long, got %d", challengeLength, len(value)))
+		}
+		acc, found := accounts[record.Name]
+		if !found {
+			var err error
+			acc, err = p.selectAccount(zone, record.Name)
+			if err != nil {
+				return nil, err
+			}
+			accounts[record.Name] = acc
+		}
+		relative := p.relativize(zone, record.Name)
+		name, err := normalizeName(zone, relative)
+		if err != nil && len(p.Configs) == 0 && len(p.NestedConfigs) == 0 {
+			// The single account does not depend on the name, so names
+			// that cannot be normalized are still accepted.
+			name, err = strings.Trim(libdns.AbsoluteName(relative, zone), "."), nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if p.VerifyAfterUpdate {
+			// Fail before any update if the value cannot be verified.
+			_, err = p.verifyName(*acc, name)
+			if err != nil {
+				return nil, err
+			}
+		}
+		items = append(items, appendItem{index: len(items), record: record, value: value, name: name, acc: *acc})
+	}
+	return items, nil
+}
+
+// groupByServer groups items by account server URL. Groups are ordered
+// by their first item, and items keep their order within a group.
+func groupByServer(items []appendItem) [][]appendItem {
+	var groups [][]appendItem
+	positions := map[string]int{}
+	for _, item := range items {
+		position, found := positions[item.acc.ServerURL]
+		if !found {
+			position = len(groups)
+			positions[item.acc.ServerURL] = position
+			groups = append(groups, nil)
+		}
+		groups[position] = append(groups[position], item)
+	}
+	return groups
+}
+
+// appendGroup pushes items in order, storing appended records at their
+// indices in appended. It stops at the first failure, or before the
+// next item once ctx is done. Pushes are audited as operation.
+func (p *Provider) appendGroup(ctx context.Context, zone, operation string, items []appendItem, appended []*libdns.Record) error {
+	for _, item := range items {
+		if err := ctx.Err(); err != nil {
+			return fmt.Errorf("Appending records was interrupted: %w", err)
+		}
+		pushes := 1
+		if p.DoublePush {
+			pushes = p.rollingWindowSize()
+		}
+		for i := 0; i < pushes; i++ {
+			_, err := p.updateTxtValue(ctx, item.acc, item.value)
+			p.audit(operation, item.acc, err)
+			if err != nil {
+				return err
+			}
+			p.recordPush(zone, item.record.Name, item.acc, item.value)
+		}
+		if p.VerifyAfterUpdate {
+			err := p.verifyPublished(ctx, item.acc, item.name, item.value)
+			if err != nil {
+				return err
+			}
+		}
+		appended[item.index] = &libdns.Record{Type: "TXT", Name: item.name + ".", Value: item.value}
+	}
+	return nil
+}
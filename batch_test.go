@@ -0,0 +1,152 @@
+package acmedns
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/libdns/libdns"
+)
+
+func TestAppendRecordsToSeveralServers(t *testing.T) {
+	for _, parallel := range []bool{false, true} {
+		srv1, srv2 := newMockServer(t), newMockServer(t)
+		config1, config2 := srv1.newDomainConfig(), srv2.newDomainConfig()
+		p := Provider{
+			Configs: map[string]DomainConfig{
+				"a.example.com": config1,
+				"b.example.com": config2,
+			},
+			ParallelServers: parallel,
+		}
+		recs := []libdns.Record{
+			{Type: "TXT", Name: "_acme-challenge.a", Value: "a1"},
+			{Type: "TXT", Name: "_acme-challenge.b", Value: "b1"},
+			{Type: "TXT", Name: "_acme-challenge.a", Value: "a2"},
+			{Type: "TXT", Name: "_acme-challenge.b", Value: "b2"},
+		}
+
+		appended, err := p.AppendRecords(context.TODO(), "example.com.", recs)
+		if err != nil {
+			t.Fatalf("Parallel %v: failed to append records: %v", parallel, err)
+		}
+		var values []string
+		for _, record := range appended {
+			values = append(values, record.Value)
+		}
+		if !reflect.DeepEqual(values, []string{"a1", "b1", "a2", "b2"}) {
+			t.Fatalf("Parallel %v: records not returned in the given order: %v", parallel, values)
+		}
+		if records := srv1.records(config1); !reflect.DeepEqual(records, []string{"a1", "a2"}) {
+			t.Fatalf("Parallel %v: unexpected TXT records %v on first server", parallel, records)
+		}
+		if records := srv2.records(config2); !reflect.DeepEqual(records, []string{"b1", "b2"}) {
+			t.Fatalf("Parallel %v: unexpected TXT records %v on second server", parallel, records)
+		}
+	}
+}
+
+func TestAppendRecordsValidatesBeforeUpdating(t *testing.T) {
+	srv := newMockServer(t)
+	p := Provider{Configs: map[string]DomainConfig{"example.com": srv.newDomainConfig()}}
+	recs := []libdns.Record{makeRecord("value"), {Type: "TXT", Name: "_acme-challenge.unknown", Value: "value"}}
+	_, err := p.AppendRecords(context.TODO(), "example.com.", recs)
+	if err == nil {
+		t.Fatal("Expected an error for record without config")
+	}
+	if len(srv.requests) != 0 {
+		t.Fatalf("Expected no requests, got %d", len(srv.requests))
+	}
+}
+
+func TestAppendRecordsCancelled(t *testing.T) {
+	srv := newMockServer(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	p := Provider{
+		Configs: map[string]DomainConfig{"example.com": srv.newDomainConfig()},
+		AuditHook: func(event AuditEvent) {
+			cancel()
+		},
+	}
+	recs := []libdns.Record{makeRecord("first"), makeRecord("second"), makeRecord("third")}
+
+	appended, err := p.AppendRecords(ctx, "example.com.", recs)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("Expected an error wrapping context.Canceled, got %v", err)
+	}
+	if len(appended) != 1 || appended[0].Value != "first" {
+		t.Fatalf("Expected only the first record, got %v", appended)
+	}
+	if len(srv.requests) != 1 {
+		t.Fatalf("Expected 1 request, got %d", len(srv.requests))
+	}
+}
+
+func TestDoublePush(t *testing.T) {
+	srv := newMockServer(t)
+	config := srv.newDomainConfig()
+	p := Provider{
+		Configs:    map[string]DomainConfig{"example.com": config},
+		DoublePush: true,
+	}
+	_, err := p.AppendRecords(context.TODO(), "example.com.", []libdns.Record{makeRecord("first"), makeRecord("second")})
+	if err != nil {
+		t.Fatal("Failed to append records: ", err)
+	}
+	if len(srv.requests) != 4 {
+		t.Fatalf("Expected 4 requests, got %d", len(srv.requests))
+	}
+	if records := srv.records(config); !reflect.DeepEqual(records, []string{"second", "second"}) {
+		t.Fatalf("Unexpected TXT records %v", records)
+	}
+
+	srv = newMockServer(t)
+	srv.window = 3
+	config = srv.newDomainConfig()
+	p = Provider{
+		Configs:           map[string]DomainConfig{"example.com": config},
+		DoublePush:        true,
+		RollingWindowSize: 3,
+	}
+	_, err = p.AppendRecords(context.TODO(), "example.com.", []libdns.Record{makeRecord("first"), makeRecord("second")})
+	if err != nil {
+		t.Fatal("Failed to append records with window of 3: ", err)
+	}
+	if len(srv.requests) != 6 {
+		t.Fatalf("Expected 6 requests with window of 3, got %d", len(srv.requests))
+	}
+	if records := srv.records(config); !reflect.DeepEqual(records, []string{"second", "second", "second"}) {
+		t.Fatalf("Unexpected TXT records %v with window of 3", records)
+	}
+}
+
+func TestSkipNonTXT(t *testing.T) {
+	srv := newMockServer(t)
+	config := srv.newDomainConfig()
+	p := Provider{Configs: map[string]DomainConfig{"example.com": config}}
+	recs := []libdns.Record{
+		{Type: "A", Name: "www", Value: "192.0.2.1"},
+		makeRecord("first"),
+		{Type: "CNAME", Name: "_acme-challenge", Value: "a.auth.example.org."},
+		makeRecord("second"),
+	}
+
+	_, err := p.AppendRecords(context.TODO(), "example.com.", recs)
+	if ErrorCode(err) != CodeBadTXT {
+		t.Fatalf("Expected an error for non-TXT records by default, got %v", err)
+	}
+
+	p.SkipNonTXT = true
+	appended, err := p.AppendRecords(context.TODO(), "example.com.", recs)
+	if err != nil {
+		t.Fatal("Failed to append mixed records: ", err)
+	}
+	if len(appended) != 2 || appended[0].Value != "first" || appended[1].Value != "second" {
+		t.Fatalf("Unexpected appended records %v", appended)
+	}
+	if records := srv.records(config); !reflect.DeepEqual(records, []string{"first", "second"}) {
+		t.Fatalf("Unexpected TXT records %v", records)
+	}
+}
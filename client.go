@@ -0,0 +1,230 @@
+package acmedns
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// User-Agent identifying this library in requests to ACME-DNS servers.
+const userAgent = "libdns-acmedns"
+
+func (p *Provider) userAgent() string {
+	if p.UserAgentSuffix == "" {
+		return userAgent
+	}
+	return userAgent + " " + p.UserAgentSuffix
+}
+
+// checkServerURL verifies that serverURL is an absolute http or https URL.
+func checkServerURL(serverURL string) error {
+	u, err := url.Parse(serverURL)
+	if err != nil {
+		return fmt.Errorf("Invalid ServerURL %q: %w", serverURL, err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" || u.Host == "" {
+		return fmt.Errorf("ServerURL %q must include the http:// or https:// scheme, for example https://auth.acme-dns.io", serverURL)
+	}
+	return nil
+}
+
+// endpointURL returns the URL of an ACME-DNS API endpoint, e.g. "/update".
+func endpointURL(serverURL string, endpoint string) (string, error) {
+	err := checkServerURL(serverURL)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(serverURL, "/") + endpoint, nil
+}
+
+// httpClient returns the client used for ACME-DNS API requests.
+func (p *Provider) httpClient() *http.Client {
+	client := &http.Client{
+		Timeout: time.Second * 30,
+		// Redirects are not followed: credential headers may be dropped
+		// on redirect, which results in confusing authentication errors.
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	if transport := p.st().transports.get(p); transport != nil {
+		client.Transport = transport
+	}
+	return client
+}
+
+// transportKey holds the Provider options a transport is built from.
+type transportKey struct {
+	serverName string
+	pinned     string
+	minVersion uint16
+	idleConn   time.Duration
+}
+
+// transportCache keeps the transport built by Provider.transport, so
+// connections are reused across requests. It is rebuilt when the
+// options it was built from change.
+type transportCache struct {
+	mu        sync.Mutex
+	key       transportKey
+	transport *http.Transport
+}
+
+func (c *transportCache) get(p *Provider) *http.Transport {
+	key := transportKey{
+		serverName: p.TLSServerName,
+		pinned:     p.PinnedCertSHA256,
+		minVersion: p.MinTLSVersion,
+		idleConn:   p.IdleConnTimeout,
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.transport == nil || c.key != key {
+		if c.transport != nil {
+			c.transport.CloseIdleConnections()
+		}
+		c.key = key
+		c.transport = p.transport()
+	}
+	return c.transport
+}
+
+// reset drops the cached transport and closes its idle connections.
+func (c *transportCache) reset() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.transport != nil {
+		c.transport.CloseIdleConnections()
+	}
+	c.transport = nil
+}
+
+// transport returns a transport configured with Provider TLS and
+// connection options, or nil if none are set and http.DefaultTransport
+// can be used.
+func (p *Provider) transport() *http.Transport {
+	if p.TLSServerName == "" && p.PinnedCertSHA256 == "" && p.MinTLSVersion == 0 && p.IdleConnTimeout == 0 {
+		return nil
+	}
+	tlsConfig := &tls.Config{
+		ServerName: p.TLSServerName,
+		MinVersion: tls.VersionTLS12,
+	}
+	if p.MinTLSVersion != 0 {
+		tlsConfig.MinVersion = p.MinTLSVersion
+	}
+	if p.PinnedCertSHA256 != "" {
+		// The pinned fingerprint replaces verification against CAs.
+		tlsConfig.InsecureSkipVerify = true
+		tlsConfig.VerifyPeerCertificate = pinnedCertVerifier(p.PinnedCertSHA256)
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	if p.IdleConnTimeout != 0 {
+		transport.IdleConnTimeout = p.IdleConnTimeout
+	}
+	return transport
+}
+
+// pinnedCertVerifier returns a tls.Config.VerifyPeerCertificate function
+// accepting only a leaf certificate with the given SHA-256 fingerprint.
+// The fingerprint is hex-encoded, optionally with colons between bytes.
+func pinnedCertVerifier(fingerprint string) func([][]byte, [][]*x509.Certificate) error {
+	pinned := strings.ToLower(strings.ReplaceAll(fingerprint, ":", ""))
+	return func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		if len(rawCerts) == 0 {
+			return fmt.Errorf("ACME-DNS server presented no certificate")
+		}
+		sum := sha256.Sum256(rawCerts[0])
+		if hex.EncodeToString(sum[:]) != pinned {
+			return fmt.Errorf("ACME-DNS server certificate fingerprint %x does not match PinnedCertSHA256", sum)
+		}
+		return nil
+	}
+}
+
+func gzipBody(body []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	_, err := w.Write(body)
+	if err == nil {
+		err = w.Close()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Error while compressing request: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// etagStore remembers the last ETag returned for each account.
+type etagStore struct {
+	mu     sync.Mutex
+	values map[string]string
+}
+
+func (s *etagStore) get(acc account) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.values[historyKey(acc)]
+}
+
+func (s *etagStore) set(acc account, etag string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.values == nil {
+		s.values = map[string]string{}
+	}
+	if etag == "" {
+		delete(s.values, historyKey(acc))
+		return
+	}
+	s.values[historyKey(acc)] = etag
+}
+
+// reset forgets all ETags.
+func (s *etagStore) reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.values = nil
+}
+
+// keyedLimiter limits the number of concurrent operations per key, e.g.
+// requests per server URL.
+type keyedLimiter struct {
+	mu    sync.Mutex
+	slots map[string]chan struct{}
+}
+
+// acquire waits for one of limit slots of key and returns a function
+// releasing it. A limit of zero or less means no limit.
+func (l *keyedLimiter) acquire(ctx context.Context, key string, limit int) (release func(), err error) {
+	if limit <= 0 {
+		return func() {}, nil
+	}
+	l.mu.Lock()
+	if l.slots == nil {
+		l.slots = map[string]chan struct{}{}
+	}
+	slots, found := l.slots[key]
+	if !found || cap(slots) != limit {
+		slots = make(chan struct{}, limit)
+		l.slots[key] = slots
+	}
+	l.mu.Unlock()
+	select {
+	case slots <- struct{}{}:
+		return func() { <-slots }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
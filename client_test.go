@@ -0,0 +1,427 @@
+package acmedns
+
+import (
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/libdns/libdns"
+)
+
+// localhostURL returns srv.URL with the IP address replaced by localhost,
+// a name not covered by the httptest certificate.
+func localhostURL(srv *httptest.Server) string {
+	return strings.Replace(srv.URL, "127.0.0.1", "localhost", 1)
+}
+
+func TestTLSServerName(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+	roots := x509.NewCertPool()
+	roots.AddCert(srv.Certificate())
+
+	p := Provider{TLSServerName: "example.com"}
+	transport := p.transport()
+	transport.TLSClientConfig.RootCAs = roots
+	resp, err := (&http.Client{Transport: transport}).Get(localhostURL(srv))
+	if err != nil {
+		t.Fatal("Request with TLSServerName failed: ", err)
+	}
+	resp.Body.Close()
+
+	p = Provider{TLSServerName: "localhost"}
+	transport = p.transport()
+	transport.TLSClientConfig.RootCAs = roots
+	_, err = (&http.Client{Transport: transport}).Get(localhostURL(srv))
+	if err == nil {
+		t.Fatal("Expected certificate name mismatch")
+	}
+}
+
+func TestServerURLScheme(t *testing.T) {
+	tests := []struct {
+		serverURL string
+		valid     bool
+	}{
+		{serverURL: "auth.acme-dns.io", valid: false},
+		{serverURL: "auth.acme-dns.io:443", valid: false},
+		{serverURL: "ftp://auth.acme-dns.io", valid: false},
+		{serverURL: "http://auth.acme-dns.io", valid: true},
+		{serverURL: "https://auth.acme-dns.io", valid: true},
+		{serverURL: "https://auth.acme-dns.io/", valid: true},
+	}
+	for _, test := range tests {
+		p := Provider{
+			Username:  "user",
+			Password:  "password",
+			Subdomain: "subdomain",
+			ServerURL: test.serverURL,
+		}
+		err := p.Validate()
+		if (err == nil) != test.valid {
+			t.Fatalf("Validate() for ServerURL %q returned %v", test.serverURL, err)
+		}
+		if !test.valid && !strings.Contains(err.Error(), "scheme") {
+			t.Fatalf("Expected error to mention the scheme, got: %v", err)
+		}
+		_, err = endpointURL(test.serverURL, "/update")
+		if (err == nil) != test.valid {
+			t.Fatalf("endpointURL() for ServerURL %q returned %v", test.serverURL, err)
+		}
+	}
+
+	url, _ := endpointURL("https://auth.acme-dns.io/", "/update")
+	if url != "https://auth.acme-dns.io/update" {
+		t.Fatalf("Unexpected update URL %s", url)
+	}
+}
+
+func TestIPv6ServerURL(t *testing.T) {
+	tests := []struct {
+		serverURL string
+		expected  string
+	}{
+		{serverURL: "https://[2001:db8::1]", expected: "https://[2001:db8::1]/update"},
+		{serverURL: "https://[2001:db8::1]:8443", expected: "https://[2001:db8::1]:8443/update"},
+		{serverURL: "https://[2001:db8::1]:8443/acme-dns/", expected: "https://[2001:db8::1]:8443/acme-dns/update"},
+	}
+	for _, test := range tests {
+		url, err := endpointURL(test.serverURL, "/update")
+		if err != nil {
+			t.Fatalf("endpointURL(%q) failed: %v", test.serverURL, err)
+		}
+		if url != test.expected {
+			t.Fatalf("endpointURL(%q) = %q, expected %q", test.serverURL, url, test.expected)
+		}
+	}
+
+	p := Provider{Configs: map[string]DomainConfig{
+		"a.example.com": {Subdomain: "sub", ServerURL: "https://[2001:db8::1]:8443"},
+		"b.example.com": {ServerURL: "https://[2001:db8::1]:8443"},
+	}}
+	if urls := p.ServerURLs(); len(urls) != 1 || urls[0] != "https://[2001:db8::1]:8443" {
+		t.Fatalf("Unexpected server URLs %v", urls)
+	}
+	if fullDomain := deriveFullDomain("", "sub", "https://[2001:db8::1]:8443"); fullDomain != "" {
+		t.Fatalf("Unexpected FullDomain %q derived from IPv6 literal", fullDomain)
+	}
+}
+
+func TestIPv6ServerRequests(t *testing.T) {
+	listener, err := net.Listen("tcp", "[::1]:0")
+	if err != nil {
+		t.Skip("IPv6 loopback is not available: ", err)
+	}
+	srv := &httptest.Server{
+		Listener: listener,
+		Config: &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != "/acme-dns/update" && r.URL.Path != "/acme-dns/health" {
+				http.NotFound(w, r)
+			}
+		})},
+	}
+	srv.Start()
+	defer srv.Close()
+	serverURL := srv.URL + "/acme-dns"
+	if !strings.HasPrefix(serverURL, "http://[::1]:") {
+		t.Fatalf("Unexpected test server URL %s", serverURL)
+	}
+	p := Provider{ServerURL: serverURL}
+
+	_, err = p.updateTxtValue(context.TODO(), account{ServerURL: serverURL}, "value")
+	if err != nil {
+		t.Fatal("Update via IPv6 literal failed: ", err)
+	}
+	if report := p.HealthReport(context.TODO()); report[serverURL] != nil {
+		t.Fatal("Health check via IPv6 literal failed: ", report[serverURL])
+	}
+}
+
+func TestCompressRequests(t *testing.T) {
+	var got map[string]string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Content-Encoding") != "gzip" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		body, err := gzip.NewReader(r.Body)
+		if err == nil {
+			err = json.NewDecoder(body).Decode(&got)
+		}
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	}))
+	defer srv.Close()
+	p := Provider{CompressRequests: true}
+
+	_, err := p.updateTxtValue(context.TODO(), account{Subdomain: "subdomain", ServerURL: srv.URL}, "value")
+	if err != nil {
+		t.Fatal("Compressed update failed: ", err)
+	}
+	if got["subdomain"] != "subdomain" || got["txt"] != "value" {
+		t.Fatalf("Unexpected decompressed payload %v", got)
+	}
+}
+
+func TestPinnedCertSHA256(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+	sum := sha256.Sum256(srv.Certificate().Raw)
+	acc := account{ServerURL: srv.URL}
+
+	p := Provider{PinnedCertSHA256: strings.ToUpper(hex.EncodeToString(sum[:]))}
+	_, err := p.updateTxtValue(context.TODO(), acc, "value")
+	if err != nil {
+		t.Fatal("Update with pinned certificate failed: ", err)
+	}
+
+	sum[0] ^= 0xff
+	p = Provider{PinnedCertSHA256: hex.EncodeToString(sum[:])}
+	_, err = p.updateTxtValue(context.TODO(), acc, "value")
+	if err == nil || !strings.Contains(err.Error(), "fingerprint") {
+		t.Fatalf("Expected fingerprint mismatch, got: %v", err)
+	}
+}
+
+func TestMinTLSVersion(t *testing.T) {
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	srv.TLS = &tls.Config{MaxVersion: tls.VersionTLS12}
+	srv.StartTLS()
+	defer srv.Close()
+	roots := x509.NewCertPool()
+	roots.AddCert(srv.Certificate())
+
+	p := Provider{MinTLSVersion: tls.VersionTLS12}
+	transport := p.transport()
+	if transport.TLSClientConfig.MinVersion != tls.VersionTLS12 {
+		t.Fatalf("Unexpected minimum TLS version %x", transport.TLSClientConfig.MinVersion)
+	}
+	transport.TLSClientConfig.RootCAs = roots
+	resp, err := (&http.Client{Transport: transport}).Get(srv.URL)
+	if err != nil {
+		t.Fatal("TLS 1.2 handshake failed: ", err)
+	}
+	resp.Body.Close()
+
+	p = Provider{MinTLSVersion: tls.VersionTLS13}
+	transport = p.transport()
+	transport.TLSClientConfig.RootCAs = roots
+	_, err = (&http.Client{Transport: transport}).Get(srv.URL)
+	if err == nil {
+		t.Fatal("Expected handshake with TLS 1.2 server to be refused")
+	}
+}
+
+func TestConditionalUpdates(t *testing.T) {
+	var mu sync.Mutex
+	version := 1
+	unavailable := false
+	var ifMatch []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		ifMatch = append(ifMatch, r.Header.Get("If-Match"))
+		if unavailable {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		etag := `"` + strconv.Itoa(version) + `"`
+		if match := r.Header.Get("If-Match"); match != "" && match != etag {
+			w.Header().Set("ETag", etag)
+			w.WriteHeader(http.StatusPreconditionFailed)
+			return
+		}
+		version++
+		w.Header().Set("ETag", `"`+strconv.Itoa(version)+`"`)
+	}))
+	defer srv.Close()
+	acc := account{Domain: "example.com", Subdomain: "subdomain", ServerURL: srv.URL}
+	p := Provider{ConditionalUpdates: true}
+
+	for i := 0; i < 2; i++ {
+		_, err := p.updateTxtValue(context.TODO(), acc, "value")
+		if err != nil {
+			t.Fatal("Conditional update failed: ", err)
+		}
+	}
+	if ifMatch[0] != "" || ifMatch[1] != `"2"` {
+		t.Fatalf("Unexpected If-Match headers %q", ifMatch)
+	}
+
+	mu.Lock()
+	version++ // concurrent writer
+	mu.Unlock()
+	_, err := p.updateTxtValue(context.TODO(), acc, "value")
+	var conflict *ConflictError
+	if !errors.As(err, &conflict) {
+		t.Fatalf("Expected ConflictError, got: %v", err)
+	}
+	if conflict.Domain != "example.com" || conflict.ETag != `"3"` {
+		t.Fatalf("Unexpected conflict %+v", conflict)
+	}
+
+	_, err = p.updateTxtValue(context.TODO(), acc, "value")
+	if err != nil {
+		t.Fatal("Update with refreshed ETag failed: ", err)
+	}
+
+	mu.Lock()
+	unavailable = true
+	mu.Unlock()
+	_, err = p.updateTxtValue(context.TODO(), acc, "value")
+	if err == nil {
+		t.Fatal("Expected update to fail while server is unavailable")
+	}
+	mu.Lock()
+	unavailable = false
+	mu.Unlock()
+	_, err = p.updateTxtValue(context.TODO(), acc, "value")
+	if err != nil {
+		t.Fatal("ETag was not kept across an error response: ", err)
+	}
+	if last := ifMatch[len(ifMatch)-1]; last != `"5"` {
+		t.Fatalf("Expected If-Match \"5\" after an error response, got %q", last)
+	}
+}
+
+// newConnCountingServer returns a TLS mock server counting the
+// connections opened to it, and a provider pinned to its certificate.
+func newConnCountingServer(t testing.TB, conns *int32) (*mockServer, *Provider) {
+	s := &mockServer{
+		accounts: map[string]DomainConfig{},
+		txt:      map[string][]string{},
+	}
+	s.Server = httptest.NewUnstartedServer(http.HandlerFunc(s.handleUpdate))
+	s.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt32(conns, 1)
+		}
+	}
+	s.StartTLS()
+	t.Cleanup(s.Close)
+	sum := sha256.Sum256(s.Certificate().Raw)
+	p := &Provider{
+		Configs:          map[string]DomainConfig{"example.com": s.newDomainConfig()},
+		PinnedCertSHA256: hex.EncodeToString(sum[:]),
+	}
+	return s, p
+}
+
+func TestConnectionReuse(t *testing.T) {
+	var conns int32
+	_, p := newConnCountingServer(t, &conns)
+	recs := []libdns.Record{makeRecord("first"), makeRecord("second"), makeRecord("third")}
+	_, err := p.AppendRecords(context.TODO(), "example.com", recs)
+	if err != nil {
+		t.Fatal("Failed to append records: ", err)
+	}
+	_, err = p.AppendRecords(context.TODO(), "example.com", recs)
+	if err != nil {
+		t.Fatal("Failed to append records: ", err)
+	}
+	if conns != 1 {
+		t.Fatalf("Expected 1 connection, got %d", conns)
+	}
+}
+
+func BenchmarkAppendRecords(b *testing.B) {
+	var conns int32
+	_, p := newConnCountingServer(b, &conns)
+	recs := []libdns.Record{makeRecord("first"), makeRecord("second")}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, err := p.AppendRecords(context.TODO(), "example.com", recs)
+		if err != nil {
+			b.Fatal("Failed to append records: ", err)
+		}
+	}
+	b.ReportMetric(float64(atomic.LoadInt32(&conns))/float64(b.N), "conns/op")
+}
+
+func TestIdleConnTimeout(t *testing.T) {
+	p := Provider{IdleConnTimeout: 10 * time.Second}
+	transport, ok := p.httpClient().Transport.(*http.Transport)
+	if !ok {
+		t.Fatal("Expected a custom transport")
+	}
+	if transport.IdleConnTimeout != 10*time.Second {
+		t.Fatalf("Unexpected idle connection timeout %v", transport.IdleConnTimeout)
+	}
+	if transport.TLSClientConfig.MinVersion != tls.VersionTLS12 {
+		t.Fatalf("Unexpected minimum TLS version %x", transport.TLSClientConfig.MinVersion)
+	}
+
+	p.IdleConnTimeout = 20 * time.Second
+	if transport := p.httpClient().Transport.(*http.Transport); transport.IdleConnTimeout != 20*time.Second {
+		t.Fatalf("Transport was not rebuilt, idle connection timeout %v", transport.IdleConnTimeout)
+	}
+}
+
+// newConcurrencyServer returns a server tracking the maximum number of
+// requests it handled at a time.
+func newConcurrencyServer(t *testing.T, maxInFlight *int32) *httptest.Server {
+	var inFlight int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&inFlight, 1)
+		defer atomic.AddInt32(&inFlight, -1)
+		for {
+			highest := atomic.LoadInt32(maxInFlight)
+			if n <= highest || atomic.CompareAndSwapInt32(maxInFlight, highest, n) {
+				break
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestPerServerConcurrency(t *testing.T) {
+	var max1, max2 int32
+	srv1, srv2 := newConcurrencyServer(t, &max1), newConcurrencyServer(t, &max2)
+	p := Provider{
+		Configs: map[string]DomainConfig{
+			"a.example.com": {Username: "user", Subdomain: "a", ServerURL: srv1.URL},
+			"b.example.com": {Username: "user", Subdomain: "b", ServerURL: srv2.URL},
+		},
+		PerServerConcurrency: 2,
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 12)
+	for i := 0; i < 6; i++ {
+		for _, name := range []string{"_acme-challenge.a", "_acme-challenge.b"} {
+			wg.Add(1)
+			go func(name string) {
+				defer wg.Done()
+				_, err := p.AppendRecords(context.TODO(), "example.com.", []libdns.Record{{Type: "TXT", Name: name, Value: "value"}})
+				errs <- err
+			}(name)
+		}
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal("Failed to append records: ", err)
+		}
+	}
+	if max1 != 2 || max2 != 2 {
+		t.Fatalf("Expected at most 2 concurrent requests per server, got %d and %d", max1, max2)
+	}
+}
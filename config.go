@@ -0,0 +1,223 @@
+package acmedns
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/libdns/libdns"
+)
+
+// Domain reported by Provider.Domains for the single account used
+// for all domains.
+const SingleAccountDomain = "*"
+
+// LoadConfigEnv reads Configs from the environment variable varName.
+// The variable must hold a JSON object mapping domains to DomainConfig,
+// in the acme-dns-client storage file format. Loaded configs are merged
+// into Provider.Configs, configs of the same domains are handled as
+// set by Provider.MergePolicy.
+func (p *Provider) LoadConfigEnv(varName string) error {
+	data, found := os.LookupEnv(varName)
+	if !found {
+		return fmt.Errorf("Environment variable %s is not set", varName)
+	}
+	var configs map[string]DomainConfig
+	err := json.Unmarshal([]byte(data), &configs)
+	if err != nil {
+		return fmt.Errorf("Error while unmarshalling configs from environment variable %s: %w", varName, err)
+	}
+	return p.mergeConfigs(configs)
+}
+
+// mergeConfigs merges configs into Provider.Configs according to
+// Provider.MergePolicy. With "error", nothing is merged if any domain
+// is already configured.
+func (p *Provider) mergeConfigs(configs map[string]DomainConfig) error {
+	switch p.MergePolicy {
+	case "", "last-wins", "first-wins":
+	case "error":
+		var duplicates []string
+		for domain := range configs {
+			if _, found := p.Configs[domain]; found {
+				duplicates = append(duplicates, domain)
+			}
+		}
+		if len(duplicates) > 0 {
+			sort.Strings(duplicates)
+			return fmt.Errorf("Configs for domains %s already exist", strings.Join(duplicates, ", "))
+		}
+	default:
+		return fmt.Errorf("Unknown merge policy %q", p.MergePolicy)
+	}
+	if p.Configs == nil {
+		p.Configs = map[string]DomainConfig{}
+	}
+	for domain, config := range configs {
+		if _, found := p.Configs[domain]; found && p.MergePolicy == "first-wins" {
+			continue
+		}
+		p.Configs[domain] = config
+	}
+	return nil
+}
+
+// LoadCredentialFiles reads the single-account fields from the files
+// named by UsernameFile, PasswordFile, SubdomainFile and ServerURLFile.
+// Fields whose file is not set are left unchanged. Trailing newlines
+// are removed from file contents.
+func (p *Provider) LoadCredentialFiles() error {
+	files := []struct {
+		name  string
+		path  string
+		field *string
+	}{
+		{"UsernameFile", p.UsernameFile, &p.Username},
+		{"PasswordFile", p.PasswordFile, &p.Password},
+		{"SubdomainFile", p.SubdomainFile, &p.Subdomain},
+		{"ServerURLFile", p.ServerURLFile, &p.ServerURL},
+	}
+	for _, file := range files {
+		if file.path == "" {
+			continue
+		}
+		data, err := ioutil.ReadFile(file.path)
+		if err != nil {
+			return fmt.Errorf("Error while reading %s: %w", file.name, err)
+		}
+		*file.field = strings.TrimRight(string(data), "\r\n")
+	}
+	return nil
+}
+
+// SingleAccountConfig returns the single-account fields as the config
+// of domain, to be stored in Configs[domain], e.g. before ExportConfig.
+// Credentials are trimmed and FullDomain is derived from Subdomain and
+// ServerURL, as when the fields are used directly. Missing fields are
+// left empty, see Validate.
+func (p *Provider) SingleAccountConfig(domain string) DomainConfig {
+	return configAccount(domain, DomainConfig{
+		Username:  p.Username,
+		Password:  p.Password,
+		Subdomain: p.Subdomain,
+		ServerURL: p.ServerURL,
+	}).config()
+}
+
+// ExportConfig writes Provider.Configs to w in the acme-dns-client
+// storage file format, indented and with domains sorted. Unset fields
+// are omitted. The output can be read by LoadConfigEnv or by
+// unmarshalling it into Configs.
+func (p *Provider) ExportConfig(w io.Writer) error {
+	configs := p.Configs
+	if configs == nil {
+		configs = map[string]DomainConfig{}
+	}
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	err := encoder.Encode(configs)
+	if err != nil {
+		return fmt.Errorf("Error while exporting configs: %w", err)
+	}
+	return nil
+}
+
+// allConfigs returns the configs of Configs and NestedConfigs keyed by
+// domain. The zone default of NestedConfigs is keyed by the zone and
+// other entries by the domain of their record name, as returned by
+// NormalizeDomain. NestedConfigs entries take precedence over Configs,
+// as when accounts are selected.
+func (p *Provider) allConfigs() map[string]DomainConfig {
+	if len(p.NestedConfigs) == 0 {
+		return p.Configs
+	}
+	configs := make(map[string]DomainConfig, len(p.Configs))
+	for domain, config := range p.Configs {
+		configs[domain] = config
+	}
+	for zone, names := range p.NestedConfigs {
+		for name, config := range names {
+			domain := strings.Trim(zone, ".")
+			if name != "" {
+				normalized, err := NormalizeDomain(zone, name)
+				if err != nil {
+					normalized = strings.Trim(libdns.AbsoluteName(name, zone), ".")
+				}
+				domain = normalized
+			}
+			configs[domain] = config
+		}
+	}
+	return configs
+}
+
+// Domains returns sorted domains of Provider.Configs and
+// Provider.NestedConfigs, see allConfigs. In single-account mode, it
+// returns SingleAccountDomain instead.
+func (p *Provider) Domains() []string {
+	configs := p.allConfigs()
+	if len(configs) == 0 {
+		if p.checkAccountFields() != nil {
+			return []string{}
+		}
+		return []string{SingleAccountDomain}
+	}
+	domains := make([]string, 0, len(configs))
+	for domain := range configs {
+		domains = append(domains, domain)
+	}
+	sort.Strings(domains)
+	return domains
+}
+
+// ConfigSchema returns a JSON Schema document describing Configs, i.e.
+// the acme-dns-client storage file format. It is generated from the JSON
+// field tags of the fields DomainConfig is decoded from, including the
+// legacy "full_domain" and "serverurl" names.
+func ConfigSchema() []byte {
+	properties := map[string]interface{}{}
+	t := reflect.TypeOf(domainConfigJSON{})
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name := strings.Split(field.Tag.Get("json"), ",")[0]
+		if name == "" || name == "-" {
+			continue
+		}
+		properties[name] = jsonSchema(field.Type)
+	}
+	schema := map[string]interface{}{
+		"$schema": "http://json-schema.org/draft-07/schema#",
+		"title":   "ACME-DNS domain configs",
+		"type":    "object",
+		"additionalProperties": map[string]interface{}{
+			"type":       "object",
+			"properties": properties,
+		},
+	}
+	data, err := json.MarshalIndent(schema, "", "  ")
+	if err != nil {
+		panic(err)
+	}
+	return data
+}
+
+// jsonSchema returns the JSON Schema of values of type t.
+func jsonSchema(t reflect.Type) map[string]interface{} {
+	switch t.Kind() {
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Slice, reflect.Array:
+		return map[string]interface{}{"type": "array", "items": jsonSchema(t.Elem())}
+	default:
+		return map[string]interface{}{"type": "object"}
+	}
+}
@@ -0,0 +1,355 @@
+package acmedns
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestLoadConfigEnv(t *testing.T) {
+	t.Setenv("ACMEDNS_CONFIGS", `{
+		"example.com": {
+			"username": "user",
+			"password": "password",
+			"subdomain": "subdomain",
+			"fulldomain": "subdomain.auth.acme-dns.io",
+			"server_url": "https://auth.acme-dns.io"
+		}
+	}`)
+	p := Provider{Configs: map[string]DomainConfig{"other.com": {Username: "other"}}}
+
+	err := p.LoadConfigEnv("ACMEDNS_CONFIGS")
+	if err != nil {
+		t.Fatal("Failed to load configs: ", err)
+	}
+	acc, err := p.selectAccount("example.com.", "_acme-challenge")
+	if err != nil {
+		t.Fatal("Failed to select account: ", err)
+	}
+	if acc.Username != "user" || acc.FullDomain != "subdomain.auth.acme-dns.io" {
+		t.Fatalf("Unexpected account %+v", acc)
+	}
+	if p.Configs["other.com"].Username != "other" {
+		t.Fatal("Existing configs were not kept")
+	}
+}
+
+func TestLoadConfigEnvErrors(t *testing.T) {
+	p := Provider{}
+	err := p.LoadConfigEnv("ACMEDNS_CONFIGS_UNSET")
+	if err == nil {
+		t.Fatal("Expected an error for unset variable")
+	}
+
+	t.Setenv("ACMEDNS_CONFIGS", `{"example.com": `)
+	err = p.LoadConfigEnv("ACMEDNS_CONFIGS")
+	if err == nil {
+		t.Fatal("Expected an error for malformed configs")
+	}
+}
+
+func TestLoadCredentialFiles(t *testing.T) {
+	dir := t.TempDir()
+	contents := map[string]string{
+		"username":   "user\n",
+		"password":   "password\r\n",
+		"subdomain":  "subdomain",
+		"server_url": "https://auth.acme-dns.io\n",
+	}
+	for name, content := range contents {
+		err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0600)
+		if err != nil {
+			t.Fatal("Failed to write secret file: ", err)
+		}
+	}
+	p := Provider{
+		UsernameFile:  filepath.Join(dir, "username"),
+		PasswordFile:  filepath.Join(dir, "password"),
+		SubdomainFile: filepath.Join(dir, "subdomain"),
+		ServerURLFile: filepath.Join(dir, "server_url"),
+	}
+	err := p.LoadCredentialFiles()
+	if err != nil {
+		t.Fatal("Failed to load credential files: ", err)
+	}
+	if p.Username != "user" || p.Password != "password" || p.Subdomain != "subdomain" || p.ServerURL != "https://auth.acme-dns.io" {
+		t.Fatalf("Unexpected credentials %q, %q, %q, %q", p.Username, p.Password, p.Subdomain, p.ServerURL)
+	}
+
+	p = Provider{Username: "user", PasswordFile: filepath.Join(dir, "missing")}
+	err = p.LoadCredentialFiles()
+	if err == nil || !strings.Contains(err.Error(), "PasswordFile") {
+		t.Fatalf("Expected an error naming PasswordFile, got %v", err)
+	}
+	if p.Username != "user" {
+		t.Fatal("Fields without files must be kept")
+	}
+}
+
+func TestExportConfig(t *testing.T) {
+	data, err := ioutil.ReadFile("testdata/storage_current.json")
+	if err != nil {
+		t.Fatal("Failed to read fixture: ", err)
+	}
+	for _, fixture := range []string{"storage_current.json", "storage_full_domain.json", "storage_serverurl.json"} {
+		legacy, err := ioutil.ReadFile(filepath.Join("testdata", fixture))
+		if err != nil {
+			t.Fatal("Failed to read fixture: ", err)
+		}
+		var p Provider
+		err = json.Unmarshal(legacy, &p.Configs)
+		if err != nil {
+			t.Fatalf("Failed to unmarshal %s: %v", fixture, err)
+		}
+		var exported bytes.Buffer
+		err = p.ExportConfig(&exported)
+		if err != nil {
+			t.Fatal("Failed to export configs: ", err)
+		}
+		if exported.String() != string(data) {
+			t.Fatalf("Configs loaded from %s exported as:\n%s", fixture, exported.String())
+		}
+	}
+
+	var exported bytes.Buffer
+	err = (&Provider{}).ExportConfig(&exported)
+	if err != nil || exported.String() != "{}\n" {
+		t.Fatalf("Unexpected export of empty configs %q, %v", exported.String(), err)
+	}
+}
+
+func TestDomains(t *testing.T) {
+	p := Provider{Configs: map[string]DomainConfig{
+		"sub.example.com": {},
+		"example.org":     {},
+		"example.com":     {},
+	}}
+	expected := []string{"example.com", "example.org", "sub.example.com"}
+	for i := 0; i < 5; i++ {
+		if domains := p.Domains(); !reflect.DeepEqual(domains, expected) {
+			t.Fatalf("Unexpected domains %v", domains)
+		}
+	}
+
+	p = Provider{
+		Username:  "user",
+		Password:  "password",
+		Subdomain: "subdomain",
+		ServerURL: "https://auth.acme-dns.io",
+	}
+	if domains := p.Domains(); !reflect.DeepEqual(domains, []string{SingleAccountDomain}) {
+		t.Fatalf("Unexpected domains %v in single-account mode", domains)
+	}
+
+	p = Provider{}
+	if domains := p.Domains(); len(domains) != 0 {
+		t.Fatalf("Unexpected domains %v without configuration", domains)
+	}
+}
+
+// validateSchema validates value against the subset of JSON Schema
+// used by ConfigSchema.
+func validateSchema(schema map[string]interface{}, value interface{}) error {
+	switch schema["type"] {
+	case "string":
+		if _, ok := value.(string); !ok {
+			return fmt.Errorf("%v is not a string", value)
+		}
+	case "array":
+		array, ok := value.([]interface{})
+		if !ok {
+			return fmt.Errorf("%v is not an array", value)
+		}
+		items, _ := schema["items"].(map[string]interface{})
+		for i, v := range array {
+			err := validateSchema(items, v)
+			if err != nil {
+				return fmt.Errorf("item %d: %w", i, err)
+			}
+		}
+	case "object":
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("%v is not an object", value)
+		}
+		properties, _ := schema["properties"].(map[string]interface{})
+		for key, v := range object {
+			if property, found := properties[key]; found {
+				err := validateSchema(property.(map[string]interface{}), v)
+				if err != nil {
+					return fmt.Errorf("%s: %w", key, err)
+				}
+			} else if additional, ok := schema["additionalProperties"].(map[string]interface{}); ok {
+				err := validateSchema(additional, v)
+				if err != nil {
+					return fmt.Errorf("%s: %w", key, err)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func readJSON(t *testing.T, path string) interface{} {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal("Failed to read test data: ", err)
+	}
+	var value interface{}
+	err = json.Unmarshal(data, &value)
+	if err != nil {
+		t.Fatalf("%s is not valid JSON: %v", path, err)
+	}
+	return value
+}
+
+func TestConfigSchema(t *testing.T) {
+	var schema interface{}
+	err := json.Unmarshal(ConfigSchema(), &schema)
+	if err != nil {
+		t.Fatal("Schema is not valid JSON: ", err)
+	}
+	if expected := readJSON(t, "testdata/config_schema.json"); !reflect.DeepEqual(schema, expected) {
+		t.Fatalf("Schema differs from testdata/config_schema.json:\n%s", ConfigSchema())
+	}
+
+	// The schema must agree with the decoder on fixed documents.
+	valid := []string{"storage_current.json", "storage_full_domain.json", "storage_serverurl.json", "storage_allowfrom.json"}
+	for _, fixture := range valid {
+		path := filepath.Join("testdata", fixture)
+		err := validateSchema(schema.(map[string]interface{}), readJSON(t, path))
+		if err != nil {
+			t.Fatalf("Valid %s rejected: %v", fixture, err)
+		}
+		if err := decodeConfigs(path); err != nil {
+			t.Fatalf("Valid %s not decoded: %v", fixture, err)
+		}
+	}
+	invalid, err := filepath.Glob("testdata/storage_invalid_*.json")
+	if err != nil || len(invalid) == 0 {
+		t.Fatal("Invalid config fixtures not found: ", err)
+	}
+	for _, fixture := range invalid {
+		if err := validateSchema(schema.(map[string]interface{}), readJSON(t, fixture)); err == nil {
+			t.Fatalf("Invalid %s accepted", fixture)
+		}
+		if err := decodeConfigs(fixture); err == nil {
+			t.Fatalf("Invalid %s decoded", fixture)
+		}
+	}
+}
+
+// decodeConfigs decodes the configs file at path like LoadConfigEnv.
+func decodeConfigs(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var configs map[string]DomainConfig
+	return json.Unmarshal(data, &configs)
+}
+
+func TestMergePolicy(t *testing.T) {
+	t.Setenv("ACMEDNS_CONFIGS", `{"example.com": {"username": "loaded"}, "new.com": {"username": "new"}}`)
+	tests := []struct {
+		policy   string
+		username string
+		fails    bool
+	}{
+		{policy: "", username: "loaded"},
+		{policy: "last-wins", username: "loaded"},
+		{policy: "first-wins", username: "existing"},
+		{policy: "error", username: "existing", fails: true},
+		{policy: "unknown", username: "existing", fails: true},
+	}
+	for _, test := range tests {
+		p := Provider{
+			Configs:     map[string]DomainConfig{"example.com": {Username: "existing"}},
+			MergePolicy: test.policy,
+		}
+		err := p.LoadConfigEnv("ACMEDNS_CONFIGS")
+		if (err != nil) != test.fails {
+			t.Fatalf("Policy %q: unexpected result %v", test.policy, err)
+		}
+		if username := p.Configs["example.com"].Username; username != test.username {
+			t.Fatalf("Policy %q: expected username %q, got %q", test.policy, test.username, username)
+		}
+		if _, found := p.Configs["new.com"]; found == test.fails {
+			t.Fatalf("Policy %q: new domain loaded %v", test.policy, found)
+		}
+	}
+}
+
+func TestSingleAccountConfig(t *testing.T) {
+	single := Provider{Username: "user", Password: "password\n", Subdomain: "subdomain", ServerURL: "https://auth.example.org"}
+	config := single.SingleAccountConfig("example.com")
+	if config.FullDomain != "subdomain.auth.example.org" || config.Password != "password" {
+		t.Fatalf("Unexpected config %+v", config)
+	}
+
+	multi := Provider{Configs: map[string]DomainConfig{"example.com": config}}
+	for _, name := range []string{"_acme-challenge", ""} {
+		expected, err := single.selectAccount("example.com.", name)
+		if err != nil {
+			t.Fatal("Failed to select single account: ", err)
+		}
+		acc, err := multi.selectAccount("example.com.", name)
+		if err != nil {
+			t.Fatal("Failed to select account from config: ", err)
+		}
+		if !reflect.DeepEqual(acc, expected) {
+			t.Fatalf("Name %q: expected account %+v, got %+v", name, expected, acc)
+		}
+	}
+
+	var exported bytes.Buffer
+	err := multi.ExportConfig(&exported)
+	if err != nil {
+		t.Fatal("Failed to export configs: ", err)
+	}
+	var loaded map[string]DomainConfig
+	err = json.Unmarshal(exported.Bytes(), &loaded)
+	if err != nil || !reflect.DeepEqual(loaded, multi.Configs) {
+		t.Fatalf("Exported configs did not round-trip: %s, %v", exported.String(), err)
+	}
+}
+
+func TestNestedConfigsAreListed(t *testing.T) {
+	fullDomainA, fullDomainB := "a.auth.example.org", "b.auth.example.org"
+	p := Provider{
+		NestedConfigs: map[string]map[string]DomainConfig{
+			"example.com": {
+				"":                    {Username: "default", Password: "p", Subdomain: "a", FullDomain: fullDomainA, ServerURL: "https://one.example.org"},
+				"_acme-challenge.sub": {Username: "sub", Password: "p", Subdomain: "b", FullDomain: fullDomainB, ServerURL: "https://two.example.org"},
+			},
+		},
+		Resolver: &fakeResolver{txt: map[string][]string{fullDomainA: {"value1"}, fullDomainB: {"value2"}}},
+	}
+	if err := p.Validate(); err != nil {
+		t.Fatal("Provider with only NestedConfigs rejected: ", err)
+	}
+	if domains := p.Domains(); !reflect.DeepEqual(domains, []string{"example.com", "sub.example.com"}) {
+		t.Fatalf("Unexpected domains %v", domains)
+	}
+	if urls := p.ServerURLs(); !reflect.DeepEqual(urls, []string{"https://one.example.org", "https://two.example.org"}) {
+		t.Fatalf("Unexpected server URLs %v", urls)
+	}
+	results, err := p.GetAllRecords(context.TODO())
+	if err != nil || len(results["example.com"]) != 1 || len(results["sub.example.com"]) != 1 {
+		t.Fatalf("Unexpected records %v, %v", results, err)
+	}
+	if results["sub.example.com"][0].Value != "value2" {
+		t.Fatalf("Unexpected records %v of sub.example.com", results["sub.example.com"])
+	}
+
+	p.NestedConfigs["example.com"]["_acme-challenge.sub"] = DomainConfig{Username: "sub", ServerURL: "two.example.org"}
+	if err := p.Validate(); err == nil {
+		t.Fatal("Expected a server URL without scheme in NestedConfigs to be rejected")
+	}
+}
@@ -0,0 +1,43 @@
+package acmedns
+
+import "context"
+
+type contextKey int
+
+const (
+	serverURLKey contextKey = iota
+	retryPolicyKey
+)
+
+// WithServerURL returns a context making updates done with it use
+// serverURL instead of the ServerURL of the selected account, also as
+// reported to hooks and audit events. Credentials are still taken from
+// the selected account.
+func WithServerURL(ctx context.Context, serverURL string) context.Context {
+	return context.WithValue(ctx, serverURLKey, serverURL)
+}
+
+func serverURLFromContext(ctx context.Context) (string, bool) {
+	serverURL, found := ctx.Value(serverURLKey).(string)
+	return serverURL, found
+}
+
+// contextAccount returns acc with the server URL set by WithServerURL
+// applied, if any.
+func contextAccount(ctx context.Context, acc account) account {
+	if serverURL, found := serverURLFromContext(ctx); found {
+		acc.ServerURL = serverURL
+	}
+	return acc
+}
+
+// WithRetryOverride returns a context making updates done with it use
+// policy instead of Provider.RetryPolicy.
+func WithRetryOverride(ctx context.Context, policy RetryPolicy) context.Context {
+	return context.WithValue(ctx, retryPolicyKey, policy)
+}
+
+func retryPolicyFromContext(ctx context.Context) (RetryPolicy, bool) {
+	policy, found := ctx.Value(retryPolicyKey).(RetryPolicy)
+	return policy, found
+}
@@ -0,0 +1,61 @@
+package acmedns
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/libdns/libdns"
+)
+
+func TestWithServerURL(t *testing.T) {
+	configured := newMockServer(t)
+	override := newMockServer(t)
+	config := configured.newDomainConfig()
+	override.accounts[config.Username] = config
+	var auditedURL, debugURL string
+	p := Provider{
+		Configs:   map[string]DomainConfig{"example.com": config},
+		AuditHook: func(event AuditEvent) { auditedURL = event.ServerURL },
+		DebugHook: func(domain, serverURL string, status int, err error) { debugURL = serverURL },
+	}
+
+	ctx := WithServerURL(context.TODO(), override.URL)
+	_, err := p.AppendRecords(ctx, "example.com", []libdns.Record{makeRecord("value")})
+	if err != nil {
+		t.Fatal("Failed to append records: ", err)
+	}
+	if auditedURL != override.URL || debugURL != override.URL {
+		t.Fatalf("Expected hooks to report %s, got audit %s and debug %s", override.URL, auditedURL, debugURL)
+	}
+	acc := contextAccount(ctx, *configAccount("example.com", config))
+	if values := p.st().history.get(acc); len(values) != 1 {
+		t.Fatalf("Expected history of the override server, got %v", values)
+	}
+	if len(configured.requests) != 0 {
+		t.Fatal("Configured server must not be used")
+	}
+	if records := override.records(config); len(records) != 1 {
+		t.Fatalf("Unexpected TXT records %v on override server", records)
+	}
+}
+
+func TestWithRetryOverride(t *testing.T) {
+	srv := newFlakyServer(t, 1, 503)
+	p := Provider{RetryPolicy: NoRetry{}}
+
+	ctx := WithRetryOverride(context.TODO(), FixedRetry{Delay: time.Millisecond, MaxRetries: 1})
+	_, err := p.updateTxtValue(ctx, account{ServerURL: srv.URL}, "value")
+	if err != nil {
+		t.Fatal("Update with retry override failed: ", err)
+	}
+	if srv.requests != 2 {
+		t.Fatalf("Expected 2 requests, got %d", srv.requests)
+	}
+
+	srv = newFlakyServer(t, 1, 503)
+	_, err = p.updateTxtValue(context.TODO(), account{ServerURL: srv.URL}, "value")
+	if err == nil || srv.requests != 1 {
+		t.Fatalf("Expected provider policy without override, got %d requests and %v", srv.requests, err)
+	}
+}
@@ -0,0 +1,129 @@
+package acmedns
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// TXT record type code.
+const dnsTypeTXT = 16
+
+// DNS response code of a name that does not exist.
+const dnsRcodeNXDomain = 3
+
+// dohResolver looks up TXT records using DNS-over-HTTPS JSON API,
+// as served by e.g. https://cloudflare-dns.com/dns-query and
+// https://dns.google/resolve.
+type dohResolver struct {
+	Endpoint string
+}
+
+type dohResponse struct {
+	Status int `json:"Status"`
+	Answer []struct {
+		Name string `json:"name"`
+		Type int    `json:"type"`
+		Data string `json:"data"`
+	} `json:"Answer"`
+}
+
+func (r dohResolver) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	u, err := url.Parse(r.Endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid DoH endpoint %q: %w", r.Endpoint, err)
+	}
+	// Keep query parameters the endpoint may already have.
+	query := u.Query()
+	query.Set("name", name)
+	query.Set("type", "TXT")
+	u.RawQuery = query.Encode()
+	req, err := http.NewRequestWithContext(ctx, "GET", u.String(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("Error while creating DoH request: %w", err)
+	}
+	req.Header.Set("Accept", "application/dns-json")
+	client := &http.Client{Timeout: time.Second * 30}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("Error while reading DoH response: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("DoH query resulted in response code %d", resp.StatusCode)
+	}
+	var answer dohResponse
+	err = json.NewDecoder(resp.Body).Decode(&answer)
+	if err != nil {
+		return nil, fmt.Errorf("Error while unmarshalling DoH response: %w", err)
+	}
+	if answer.Status == dnsRcodeNXDomain {
+		// Reported like the system resolver does, see EnsureRecord.
+		return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+	}
+	if answer.Status != 0 {
+		return nil, fmt.Errorf("DoH query for %s resulted in DNS response code %d", name, answer.Status)
+	}
+	values := []string{}
+	for _, rr := range answer.Answer {
+		if rr.Type != dnsTypeTXT {
+			continue
+		}
+		values = append(values, parseTXTData(rr.Data))
+	}
+	return values, nil
+}
+
+// parseTXTData joins the character strings of a presentation format
+// TXT record, e.g. `"abc" "def"`, into one value like net.LookupTXT does.
+// Escapes, `\"` or `\DDD` with a decimal byte value, are decoded.
+// Unquoted data is returned as is.
+func parseTXTData(data string) string {
+	if !strings.HasPrefix(data, `"`) {
+		return data
+	}
+	var b []byte
+	quoted := false
+	for i := 0; i < len(data); i++ {
+		c := data[i]
+		switch {
+		case c == '\\' && i+1 < len(data):
+			if value, ok := decimalEscape(data[i+1:]); ok {
+				b = append(b, value)
+				i += 3
+			} else {
+				b = append(b, data[i+1])
+				i++
+			}
+		case c == '"':
+			quoted = !quoted
+		case quoted:
+			b = append(b, c)
+		}
+	}
+	return string(b)
+}
+
+// decimalEscape decodes the DDD digits of a `\DDD` escape at the start
+// of s.
+func decimalEscape(s string) (byte, bool) {
+	if len(s) < 3 {
+		return 0, false
+	}
+	value := 0
+	for i := 0; i < 3; i++ {
+		if s[i] < '0' || s[i] > '9' {
+			return 0, false
+		}
+		value = value*10 + int(s[i]-'0')
+	}
+	if value > 255 {
+		return 0, false
+	}
+	return byte(value), true
+}
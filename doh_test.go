@@ -0,0 +1,112 @@
+package acmedns
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestGetAllRecordsWithDoHEndpoint(t *testing.T) {
+	doh := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("name") != "a.auth.example.org" || r.URL.Query().Get("type") != "TXT" {
+			json.NewEncoder(w).Encode(map[string]interface{}{"Status": 3})
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"Status": 0,
+			"Answer": []map[string]interface{}{
+				{"name": "a.auth.example.org.", "type": 16, "data": `"value1"`},
+				{"name": "a.auth.example.org.", "type": 16, "data": `"val" "ue\"2"`},
+				{"name": "a.auth.example.org.", "type": 5, "data": "ignored.example.org."},
+			},
+		})
+	}))
+	defer doh.Close()
+	p := Provider{
+		Configs: map[string]DomainConfig{
+			"example.com": {FullDomain: "a.auth.example.org"},
+			"missing.com": {FullDomain: "b.auth.example.org"},
+		},
+		DoHEndpoint: doh.URL,
+	}
+
+	results, err := p.GetAllRecords(context.TODO())
+	if err == nil {
+		t.Fatal("Expected NXDOMAIN to result in an error")
+	}
+	records := results["example.com"]
+	if len(records) != 2 {
+		t.Fatalf("Expected 2 records, got %v", records)
+	}
+	if records[0].Value != "value1" || records[1].Value != `value"2` {
+		t.Fatalf("Unexpected records %v", records)
+	}
+}
+
+func TestParseTXTData(t *testing.T) {
+	tests := []struct {
+		data, expected string
+	}{
+		{data: `"value"`, expected: "value"},
+		{data: `"val" "ue"`, expected: "value"},
+		{data: `"a\"b\\c"`, expected: `a"b\c`},
+		{data: `"a\032b\059"`, expected: "a b;"},
+		{data: `"\195\169"`, expected: "é"},
+		{data: `"\999"`, expected: "999"},
+		{data: "unquoted", expected: "unquoted"},
+	}
+	for _, test := range tests {
+		if value := parseTXTData(test.data); value != test.expected {
+			t.Fatalf("Parsed %s as %q, expected %q", test.data, value, test.expected)
+		}
+	}
+}
+
+func TestDoHEndpointWithQuery(t *testing.T) {
+	doh := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		if query.Get("key") != "secret" || query.Get("name") != "a.auth.example.org" || query.Get("type") != "TXT" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"Status": 0,
+			"Answer": []map[string]interface{}{{"name": "a.auth.example.org.", "type": 16, "data": `"value"`}},
+		})
+	}))
+	defer doh.Close()
+	values, err := dohResolver{Endpoint: doh.URL + "/resolve?key=secret"}.LookupTXT(context.TODO(), "a.auth.example.org")
+	if err != nil || len(values) != 1 || values[0] != "value" {
+		t.Fatalf("Unexpected lookup result %v, %v", values, err)
+	}
+}
+
+func TestEnsureRecordWithDoHNXDomain(t *testing.T) {
+	doh := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{"Status": 3})
+	}))
+	defer doh.Close()
+	srv := newMockServer(t)
+	config := srv.newDomainConfig()
+	p := Provider{
+		Configs:     map[string]DomainConfig{"example.com": config},
+		DoHEndpoint: doh.URL,
+	}
+
+	_, err := p.resolver().LookupTXT(context.TODO(), config.FullDomain)
+	var dnsErr *net.DNSError
+	if !errors.As(err, &dnsErr) || !dnsErr.IsNotFound {
+		t.Fatalf("Expected a not found DNS error, got %v", err)
+	}
+	changed, err := p.EnsureRecord(context.TODO(), "example.com.", "_acme-challenge", "value")
+	if err != nil || !changed {
+		t.Fatalf("Expected the record to be pushed, got %v, %v", changed, err)
+	}
+	if records := srv.records(config); len(records) != 1 {
+		t.Fatalf("Unexpected TXT records %v", records)
+	}
+}
@@ -0,0 +1,98 @@
+package acmedns
+
+import (
+	"errors"
+	"strings"
+)
+
+// Machine-readable error codes, see ErrorCode.
+const (
+	CodeConfigNotFound     = "config_not_found"
+	CodeMissingCredentials = "missing_credentials"
+	CodeBadTXT             = "bad_txt"
+	CodeUnauthorized       = "unauthorized"
+	CodeConflict           = "conflict"
+	CodeAPIError           = "api_error"
+)
+
+// Error is an error with a stable, machine-readable code, so callers can
+// branch on the kind of failure without parsing messages. It wraps the
+// underlying error.
+type Error struct {
+	code string
+	err  error
+}
+
+func withCode(code string, err error) error {
+	return &Error{code: code, err: err}
+}
+
+func (e *Error) Error() string {
+	return e.err.Error()
+}
+
+func (e *Error) Unwrap() error {
+	return e.err
+}
+
+// Code returns one of the Code* constants.
+func (e *Error) Code() string {
+	return e.code
+}
+
+// ErrorCode returns the code of the first error in the chain of err
+// that has one, or "" if none has.
+func ErrorCode(err error) string {
+	var coded interface{ Code() string }
+	if errors.As(err, &coded) {
+		return coded.Code()
+	}
+	return ""
+}
+
+// MultiError combines errors of several independent operations, e.g.
+// updates on different servers. errors.Is and errors.As match any of
+// the combined errors.
+type MultiError struct {
+	errs []error
+}
+
+func (e *MultiError) Error() string {
+	msgs := make([]string, 0, len(e.errs))
+	for _, err := range e.errs {
+		msgs = append(msgs, err.Error())
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// Errors returns the combined errors.
+func (e *MultiError) Errors() []error {
+	return append([]error(nil), e.errs...)
+}
+
+// Unwrap returns the combined errors.
+func (e *MultiError) Unwrap() []error {
+	return e.Errors()
+}
+
+// Is reports whether any of the combined errors matches target, for Go
+// versions whose errors.Is does not use Unwrap() []error.
+func (e *MultiError) Is(target error) bool {
+	for _, err := range e.errs {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// As finds the first of the combined errors that matches target, for Go
+// versions whose errors.As does not use Unwrap() []error.
+func (e *MultiError) As(target interface{}) bool {
+	for _, err := range e.errs {
+		if errors.As(err, target) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,154 @@
+package acmedns
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/libdns/libdns"
+)
+
+func TestErrorCodes(t *testing.T) {
+	srv := newMockServer(t)
+	config := srv.newDomainConfig()
+	badRequest := newFlakyServer(t, 1, http.StatusBadRequest)
+	conflict := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusPreconditionFailed)
+	}))
+	defer conflict.Close()
+	wrongPassword := config
+	wrongPassword.Password = "wrong"
+
+	tests := []struct {
+		name     string
+		provider *Provider
+		record   libdns.Record
+		code     string
+	}{
+		{
+			name:     "config not found",
+			provider: &Provider{Configs: map[string]DomainConfig{"other.com": config}},
+			record:   makeRecord("value"),
+			code:     CodeConfigNotFound,
+		},
+		{
+			name:     "missing credentials",
+			provider: &Provider{Username: "user"},
+			record:   makeRecord("value"),
+			code:     CodeMissingCredentials,
+		},
+		{
+			name:     "record type",
+			provider: &Provider{Configs: map[string]DomainConfig{"example.com": config}},
+			record:   libdns.Record{Type: "A", Name: "_acme-challenge", Value: "192.0.2.1"},
+			code:     CodeBadTXT,
+		},
+		{
+			name:     "TXT length",
+			provider: &Provider{Configs: map[string]DomainConfig{"example.com": config}, StrictTXTValidation: true},
+			record:   makeRecord("short"),
+			code:     CodeBadTXT,
+		},
+		{
+			name:     "unauthorized",
+			provider: &Provider{Configs: map[string]DomainConfig{"example.com": wrongPassword}},
+			record:   makeRecord("value"),
+			code:     CodeUnauthorized,
+		},
+		{
+			name:     "API error",
+			provider: &Provider{Username: "user", Password: "password", Subdomain: "subdomain", ServerURL: badRequest.URL},
+			record:   makeRecord("value"),
+			code:     CodeAPIError,
+		},
+		{
+			name:     "conflict",
+			provider: &Provider{Username: "user", Password: "password", Subdomain: "subdomain", ServerURL: conflict.URL, ConditionalUpdates: true},
+			record:   makeRecord("value"),
+			code:     CodeConflict,
+		},
+	}
+	for _, test := range tests {
+		_, err := test.provider.AppendRecords(context.TODO(), "example.com", []libdns.Record{test.record})
+		if err == nil {
+			t.Fatalf("%s: expected an error", test.name)
+		}
+		if code := ErrorCode(err); code != test.code {
+			t.Fatalf("%s: expected code %q, got %q for %v", test.name, test.code, code, err)
+		}
+	}
+}
+
+func TestErrorCodeWrapped(t *testing.T) {
+	err := fmt.Errorf("Context: %w", withCode(CodeUnauthorized, fmt.Errorf("Rejected: %w", ErrUnauthorized)))
+	if ErrorCode(err) != CodeUnauthorized {
+		t.Fatalf("Unexpected code %q", ErrorCode(err))
+	}
+	if !errors.Is(err, ErrUnauthorized) {
+		t.Fatal("Coded error must wrap the underlying error")
+	}
+	if err.Error() != "Context: Rejected: "+ErrUnauthorized.Error() {
+		t.Fatalf("Unexpected message %q", err.Error())
+	}
+	if ErrorCode(errors.New("plain")) != "" {
+		t.Fatal("Expected no code for plain errors")
+	}
+}
+
+func TestMultiError(t *testing.T) {
+	srv1, srv2 := newMockServer(t), newMockServer(t)
+	config1, config2 := srv1.newDomainConfig(), srv2.newDomainConfig()
+	config1.Password = "wrong"
+	badRequest := newFlakyServer(t, 3, http.StatusBadRequest)
+	p := Provider{
+		Configs: map[string]DomainConfig{
+			"a.example.com": config1,
+			"b.example.com": config2,
+			"c.example.com": {Username: "user", Subdomain: "c", ServerURL: badRequest.URL},
+		},
+		ParallelServers: true,
+	}
+	recs := []libdns.Record{
+		{Type: "TXT", Name: "_acme-challenge.a", Value: "a"},
+		{Type: "TXT", Name: "_acme-challenge.b", Value: "b"},
+		{Type: "TXT", Name: "_acme-challenge.c", Value: "c"},
+	}
+
+	for _, aggregation := range []string{"", "multi"} {
+		p.ErrorAggregation = aggregation
+		appended, err := p.AppendRecords(context.TODO(), "example.com.", recs)
+		var multi *MultiError
+		if !errors.As(err, &multi) || len(appended) != 1 {
+			t.Fatalf("Aggregation %q: expected *MultiError, got %v, %v", aggregation, appended, err)
+		}
+		errs := multi.Errors()
+		if len(errs) != 2 || ErrorCode(errs[0]) != CodeUnauthorized || ErrorCode(errs[1]) != CodeAPIError {
+			t.Fatalf("Aggregation %q: unexpected errors %v", aggregation, errs)
+		}
+		if !errors.Is(err, ErrUnauthorized) {
+			t.Fatalf("Aggregation %q: combined errors must match errors.Is", aggregation)
+		}
+		var coded *Error
+		if !errors.As(err, &coded) || coded.Code() != CodeUnauthorized {
+			t.Fatalf("Aggregation %q: combined errors must match errors.As, got %v", aggregation, coded)
+		}
+	}
+
+	p.ErrorAggregation = "first"
+	appended, err := p.AppendRecords(context.TODO(), "example.com.", recs)
+	var multi *MultiError
+	if err == nil || errors.As(err, &multi) {
+		t.Fatalf("Expected only the first error, got %v", err)
+	}
+	if !errors.Is(err, ErrUnauthorized) || len(appended) != 1 {
+		t.Fatalf("Unexpected result %v, %v", appended, err)
+	}
+
+	p.ErrorAggregation = "unknown"
+	if _, err := p.AppendRecords(context.TODO(), "example.com.", recs); err == nil {
+		t.Fatal("Expected an error for unknown error aggregation")
+	}
+}
@@ -1,5 +1,5 @@
 module github.com/libdns/acmedns
 
-go 1.17
+go 1.18
 
 require github.com/libdns/libdns v0.2.1
@@ -0,0 +1,85 @@
+package acmedns
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+)
+
+// Maximum number of concurrent health checks done by HealthReport.
+const maxConcurrentPings = 4
+
+// ServerURLs returns sorted distinct server URLs of all configured
+// accounts, including those of NestedConfigs.
+func (p *Provider) ServerURLs() []string {
+	seen := map[string]bool{}
+	if p.ServerURL != "" {
+		seen[p.ServerURL] = true
+	}
+	for _, config := range p.allConfigs() {
+		if config.ServerURL != "" {
+			seen[config.ServerURL] = true
+		}
+	}
+	urls := make([]string, 0, len(seen))
+	for serverURL := range seen {
+		urls = append(urls, serverURL)
+	}
+	sort.Strings(urls)
+	return urls
+}
+
+// ping checks ACME-DNS server health using its /health endpoint.
+func (p *Provider) ping(ctx context.Context, serverURL string) error {
+	healthURL, err := endpointURL(serverURL, "/health")
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", healthURL, nil)
+	if err != nil {
+		return fmt.Errorf("Error while creating request: %w", err)
+	}
+	req.Header.Set("User-Agent", p.userAgent())
+	resp, err := p.httpClient().Do(req)
+	if err != nil {
+		return fmt.Errorf("Error while reading response: %w", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return fmt.Errorf("ACME-DNS health check resulted in response code %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// HealthReport checks health of every distinct ACME-DNS server used by
+// the Provider configuration. Servers are checked concurrently.
+//
+// Results are keyed by server URL, nil error means the server is healthy.
+func (p *Provider) HealthReport(ctx context.Context) map[string]error {
+	urls := p.ServerURLs()
+	report := make(map[string]error, len(urls))
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, maxConcurrentPings)
+	for _, serverURL := range urls {
+		wg.Add(1)
+		go func(serverURL string) {
+			defer wg.Done()
+			var err error
+			select {
+			case sem <- struct{}{}:
+				err = p.ping(ctx, serverURL)
+				<-sem
+			case <-ctx.Done():
+				err = ctx.Err()
+			}
+			mu.Lock()
+			report[serverURL] = err
+			mu.Unlock()
+		}(serverURL)
+	}
+	wg.Wait()
+	return report
+}
@@ -0,0 +1,71 @@
+package acmedns
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func newHealthServer(t *testing.T, status int) *httptest.Server {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/health" {
+			http.NotFound(w, r)
+			return
+		}
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestHealthReport(t *testing.T) {
+	healthy := newHealthServer(t, http.StatusOK)
+	failing := newHealthServer(t, http.StatusInternalServerError)
+	p := Provider{
+		Configs: map[string]DomainConfig{
+			"a.example.com": {ServerURL: healthy.URL},
+			"b.example.com": {ServerURL: healthy.URL},
+			"c.example.com": {ServerURL: failing.URL},
+			"d.example.com": {ServerURL: "auth.acme-dns.io"},
+		},
+	}
+
+	report := p.HealthReport(context.TODO())
+	if len(report) != 3 {
+		t.Fatalf("Expected 3 servers in report, got %v", report)
+	}
+	if report[healthy.URL] != nil {
+		t.Fatalf("Expected %s to be healthy, got: %v", healthy.URL, report[healthy.URL])
+	}
+	if report[failing.URL] == nil {
+		t.Fatalf("Expected %s to be unhealthy", failing.URL)
+	}
+	if report["auth.acme-dns.io"] == nil {
+		t.Fatal("Expected server URL without scheme to be reported")
+	}
+}
+
+func TestHealthReportCancelled(t *testing.T) {
+	p := Provider{ServerURL: newHealthServer(t, http.StatusOK).URL}
+	ctx, cancel := context.WithCancel(context.TODO())
+	cancel()
+
+	report := p.HealthReport(ctx)
+	if report[p.ServerURL] == nil {
+		t.Fatal("Expected cancelled health check to fail")
+	}
+}
+
+func TestHealthReportWithNestedConfigs(t *testing.T) {
+	healthy := newHealthServer(t, http.StatusOK)
+	p := Provider{
+		NestedConfigs: map[string]map[string]DomainConfig{
+			"example.com": {"": {ServerURL: healthy.URL}},
+		},
+	}
+	report := p.HealthReport(context.TODO())
+	if err, found := report[healthy.URL]; len(report) != 1 || !found || err != nil {
+		t.Fatalf("Expected %s to be reported healthy, got %v", healthy.URL, report)
+	}
+}
@@ -0,0 +1,74 @@
+package acmedns
+
+import "sync"
+
+// Number of TXT values stock ACME-DNS keeps per account.
+const defaultRollingWindowSize = 2
+
+// valueHistory remembers TXT values recently pushed through the Provider,
+// per account. It mirrors the ACME-DNS rolling window on a best-effort
+// basis: updates made by other clients are not seen.
+type valueHistory struct {
+	mu     sync.Mutex
+	values map[string][]string
+}
+
+func historyKey(acc account) string {
+	return acc.ServerURL + "|" + acc.Subdomain
+}
+
+// push records value as pushed to acc and returns a value rolled out
+// of a window of size values, if any. A rolled out value that is still
+// in the window, having been pushed again, is not returned.
+func (h *valueHistory) push(acc account, value string, size int) (evicted string, found bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.values == nil {
+		h.values = map[string][]string{}
+	}
+	key := historyKey(acc)
+	values := append(h.values[key], value)
+	for len(values) > size {
+		evicted, found = values[0], true
+		values = values[1:]
+	}
+	h.values[key] = values
+	if found {
+		for _, v := range values {
+			if v == evicted {
+				return "", false
+			}
+		}
+	}
+	return evicted, found
+}
+
+// reset forgets all pushed values.
+func (h *valueHistory) reset() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.values = nil
+}
+
+// get returns values recently pushed to acc, oldest first.
+func (h *valueHistory) get(acc account) []string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return append([]string(nil), h.values[historyKey(acc)]...)
+}
+
+// recordPush updates value history after a successful update and
+// calls WindowEvictionHook if a value was rolled out of the window.
+func (p *Provider) recordPush(zone, name string, acc account, value string) {
+	evicted, found := p.st().history.push(acc, value, p.rollingWindowSize())
+	if found && p.WindowEvictionHook != nil {
+		p.WindowEvictionHook(zone, name, evicted)
+	}
+}
+
+func (p *Provider) rollingWindowSize() int {
+	if p.RollingWindowSize > 0 {
+		return p.RollingWindowSize
+	}
+	return defaultRollingWindowSize
+}
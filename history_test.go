@@ -0,0 +1,124 @@
+package acmedns
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/libdns/libdns"
+)
+
+func TestWindowEvictionHook(t *testing.T) {
+	srv := newMockServer(t)
+	var evicted []string
+	p := Provider{
+		Configs: map[string]DomainConfig{"example.com": srv.newDomainConfig()},
+		WindowEvictionHook: func(zone, name, value string) {
+			evicted = append(evicted, zone+" "+name+" "+value)
+		},
+	}
+
+	_, err := p.AppendRecords(context.TODO(), "example.com", []libdns.Record{makeRecord("value1"), makeRecord("value2")})
+	if err != nil {
+		t.Fatal("Failed to append records: ", err)
+	}
+	if len(evicted) != 0 {
+		t.Fatalf("Unexpected evictions %v", evicted)
+	}
+	_, err = p.AppendRecords(context.TODO(), "example.com", []libdns.Record{makeRecord("value3")})
+	if err != nil {
+		t.Fatal("Failed to append records: ", err)
+	}
+	if !reflect.DeepEqual(evicted, []string{"example.com _acme-challenge value1"}) {
+		t.Fatalf("Unexpected evictions %v", evicted)
+	}
+
+	// value2 rolls out, but is still in the window [value3 value2].
+	evicted = nil
+	_, err = p.AppendRecords(context.TODO(), "example.com", []libdns.Record{makeRecord("value2")})
+	if err != nil {
+		t.Fatal("Failed to append records: ", err)
+	}
+	if len(evicted) != 0 {
+		t.Fatalf("Unexpected evictions %v", evicted)
+	}
+
+	// With DoublePush, x rolls out twice but is reported once.
+	evicted = nil
+	p.Configs = map[string]DomainConfig{"example.com": srv.newDomainConfig()}
+	p.DoublePush = true
+	for _, value := range []string{"x", "y"} {
+		_, err = p.AppendRecords(context.TODO(), "example.com", []libdns.Record{makeRecord(value)})
+		if err != nil {
+			t.Fatal("Failed to append records: ", err)
+		}
+	}
+	if !reflect.DeepEqual(evicted, []string{"example.com _acme-challenge x"}) {
+		t.Fatalf("Unexpected evictions %v", evicted)
+	}
+}
+
+func TestGetRecordsFallbackToHistory(t *testing.T) {
+	srv := newMockServer(t)
+	config := srv.newDomainConfig()
+	p := Provider{
+		Configs:        map[string]DomainConfig{"example.com": config},
+		Resolver:       &fakeResolver{errs: map[string]error{config.FullDomain: errors.New("network unreachable")}},
+		GetRecordsMode: "resolve",
+	}
+	_, err := p.AppendRecords(context.TODO(), "example.com", []libdns.Record{makeRecord("value")})
+	if err != nil {
+		t.Fatal("Failed to append records: ", err)
+	}
+
+	_, err = p.GetRecords(context.TODO(), "example.com.")
+	if err == nil {
+		t.Fatal("Expected lookup error without fallback")
+	}
+
+	p.GetRecordsFallbackToHistory = true
+	records, err := p.GetRecords(context.TODO(), "example.com.")
+	if err != nil {
+		t.Fatal("Expected fallback to history, got: ", err)
+	}
+	if len(records) != 1 || records[0].Value != "value" || records[0].ID != config.FullDomain {
+		t.Fatalf("Unexpected records %v", records)
+	}
+}
+
+func TestRollingWindowSize(t *testing.T) {
+	srv := newMockServer(t)
+	config := srv.newDomainConfig()
+	var evicted []string
+	p := Provider{
+		Configs:           map[string]DomainConfig{"example.com": config},
+		RollingWindowSize: 3,
+		WindowEvictionHook: func(zone, name, value string) {
+			evicted = append(evicted, value)
+		},
+	}
+
+	recs := []libdns.Record{makeRecord("value1"), makeRecord("value2"), makeRecord("value3")}
+	_, err := p.AppendRecords(context.TODO(), "example.com", recs)
+	if err != nil {
+		t.Fatal("Failed to append records: ", err)
+	}
+	if len(evicted) != 0 {
+		t.Fatalf("Unexpected evictions %v", evicted)
+	}
+	_, err = p.AppendRecords(context.TODO(), "example.com", []libdns.Record{makeRecord("value4")})
+	if err != nil {
+		t.Fatal("Failed to append records: ", err)
+	}
+	if !reflect.DeepEqual(evicted, []string{"value1"}) {
+		t.Fatalf("Unexpected evictions %v", evicted)
+	}
+	acc, err := p.selectAccount("example.com", "_acme-challenge")
+	if err != nil {
+		t.Fatal("Failed to select account: ", err)
+	}
+	if values := p.st().history.get(*acc); !reflect.DeepEqual(values, []string{"value2", "value3", "value4"}) {
+		t.Fatalf("Unexpected history %v", values)
+	}
+}
@@ -0,0 +1,262 @@
+package acmedns
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/libdns/libdns"
+)
+
+// Default timeout of TXT record lookups.
+const defaultDNSTimeout = 5 * time.Second
+
+// Default maximum number of concurrent TXT record lookups.
+const defaultMaxConcurrentLookups = 8
+
+// TXTResolver looks up TXT records of a domain name.
+// *net.Resolver satisfies this interface.
+type TXTResolver interface {
+	LookupTXT(ctx context.Context, name string) ([]string, error)
+}
+
+// DomainErrors maps domains to the errors encountered while processing them.
+type DomainErrors map[string]error
+
+func (e DomainErrors) Error() string {
+	domains := make([]string, 0, len(e))
+	for domain := range e {
+		domains = append(domains, domain)
+	}
+	sort.Strings(domains)
+	msgs := make([]string, 0, len(domains))
+	for _, domain := range domains {
+		msgs = append(msgs, fmt.Sprintf("%s: %v", domain, e[domain]))
+	}
+	return strings.Join(msgs, "; ")
+}
+
+func (p *Provider) resolver() TXTResolver {
+	if p.Resolver != nil {
+		return p.Resolver
+	}
+	if p.DoHEndpoint != "" {
+		return dohResolver{Endpoint: p.DoHEndpoint}
+	}
+	if p.DNSUseTCP {
+		return &net.Resolver{PreferGo: true, Dial: dialTCP}
+	}
+	return net.DefaultResolver
+}
+
+// dialTCP connects to a DNS server over TCP, whatever network the
+// resolver asks for.
+func dialTCP(ctx context.Context, network, address string) (net.Conn, error) {
+	var dialer net.Dialer
+	return dialer.DialContext(ctx, "tcp", address)
+}
+
+// lookupTXT returns TXT records currently published at fqdn.
+func (p *Provider) lookupTXT(ctx context.Context, fqdn string) ([]libdns.Record, error) {
+	limit := p.MaxConcurrentLookups
+	if limit == 0 {
+		limit = defaultMaxConcurrentLookups
+	}
+	release, err := p.st().lookupSlots.acquire(ctx, "", limit)
+	if err != nil {
+		return nil, fmt.Errorf("TXT record lookup for %s failed: %w", fqdn, err)
+	}
+	defer release()
+	timeout := p.DNSTimeout
+	if timeout == 0 {
+		timeout = defaultDNSTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	values, err := p.resolver().LookupTXT(ctx, fqdn)
+	if err != nil {
+		return nil, fmt.Errorf("TXT record lookup for %s failed: %w", fqdn, err)
+	}
+	return txtRecords(values, fqdn), nil
+}
+
+// txtRecords converts TXT values published at fullDomain to records.
+// Record names are set to the challenge label, as passed to
+// AppendRecords, and IDs to fullDomain, the account's record at the
+// ACME-DNS server.
+func txtRecords(values []string, fullDomain string) []libdns.Record {
+	records := make([]libdns.Record, 0, len(values))
+	for _, value := range values {
+		records = append(records, libdns.Record{
+			ID:    fullDomain,
+			Type:  "TXT",
+			Name:  strings.TrimSuffix(acmePrefix, "."),
+			Value: value,
+		})
+	}
+	return records
+}
+
+// deriveFullDomain returns fullDomain or, if it is empty, derives it as
+// <subdomain>.<host of serverURL>. The derivation assumes the ACME-DNS
+// server serves DNS records under the same host name that its API uses,
+// as the default acme-dns setup does. It returns "" if nothing can be
+// derived.
+func deriveFullDomain(fullDomain, subdomain, serverURL string) string {
+	if fullDomain != "" || subdomain == "" {
+		return fullDomain
+	}
+	u, err := url.Parse(serverURL)
+	if err != nil {
+		return ""
+	}
+	host := u.Hostname()
+	if host == "" || net.ParseIP(host) != nil {
+		return ""
+	}
+	return subdomain + "." + host
+}
+
+// GetAllRecords looks up TXT records currently published for every
+// domain in Provider.Configs and Provider.NestedConfigs, keyed as by
+// Domains, that has FullDomain set or derivable from
+// Subdomain and ServerURL. It is a read-only
+// diagnostic and does not call ACME-DNS API. Lookups are done
+// concurrently, at most MaxConcurrentLookups at a time.
+//
+// Results are keyed by domain. Lookup failures do not abort the call:
+// records of successful lookups are returned together with a
+// DomainErrors value describing the failed ones.
+func (p *Provider) GetAllRecords(ctx context.Context) (map[string][]libdns.Record, error) {
+	results := map[string][]libdns.Record{}
+	errs := DomainErrors{}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for domain, config := range p.allConfigs() {
+		fullDomain := deriveFullDomain(config.FullDomain, config.Subdomain, config.ServerURL)
+		if fullDomain == "" {
+			continue
+		}
+		wg.Add(1)
+		go func(domain, fullDomain string) {
+			defer wg.Done()
+			records, err := p.lookupTXT(ctx, fullDomain)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				errs[domain] = err
+				return
+			}
+			results[domain] = records
+		}(domain, fullDomain)
+	}
+	wg.Wait()
+	if len(errs) > 0 {
+		return results, errs
+	}
+	return results, nil
+}
+
+// lookupAccount returns TXT records currently published for an account.
+func (p *Provider) lookupAccount(ctx context.Context, acc account) ([]libdns.Record, error) {
+	if acc.FullDomain == "" {
+		return nil, fmt.Errorf("FullDomain of the account for domain %s is unknown", acc.Domain)
+	}
+	return p.lookupTXT(ctx, acc.FullDomain)
+}
+
+// publishedValues looks up TXT values currently published for an account.
+func (p *Provider) publishedValues(ctx context.Context, acc account) ([]string, error) {
+	records, err := p.lookupAccount(ctx, acc)
+	if err != nil {
+		return nil, err
+	}
+	values := make([]string, 0, len(records))
+	for _, record := range records {
+		values = append(values, record.Value)
+	}
+	return values, nil
+}
+
+// Diff compares desired challenge values for the given zone and record
+// name against TXT values currently published in DNS for the selected
+// account. It returns desired values which are not published (missing)
+// and published values which are not desired (extra). An update is
+// needed only if missing is not empty.
+//
+// The account must have FullDomain set or derivable from Subdomain
+// and ServerURL.
+func (p *Provider) Diff(ctx context.Context, zone, name string, desired []string) (missing, extra []string, err error) {
+	err = p.checkZone(zone)
+	if err != nil {
+		return nil, nil, err
+	}
+	acc, err := p.selectAccount(zone, name)
+	if err != nil {
+		return nil, nil, err
+	}
+	published, err := p.publishedValues(ctx, *acc)
+	if err != nil {
+		return nil, nil, err
+	}
+	isPublished := map[string]bool{}
+	for _, value := range published {
+		isPublished[value] = true
+	}
+	isDesired := map[string]bool{}
+	for _, value := range desired {
+		isDesired[value] = true
+		if !isPublished[value] {
+			missing = append(missing, value)
+		}
+	}
+	for _, value := range published {
+		if !isDesired[value] {
+			extra = append(extra, value)
+		}
+	}
+	return missing, extra, nil
+}
+
+// EnsureRecord makes sure value is published for the given zone and
+// record name. It looks up the TXT values currently published for the
+// selected account, using the configured resolver, and updates the
+// account only if value is not among them. It reports whether an update
+// was made. The value is validated and pushed as by AppendRecords,
+// including StrictTXTValidation, DoublePush and VerifyAfterUpdate.
+//
+// The account must have FullDomain set or derivable from Subdomain
+// and ServerURL. A domain that does not exist yet counts as having no
+// values published.
+func (p *Provider) EnsureRecord(ctx context.Context, zone, name, value string) (changed bool, err error) {
+	err = p.checkZone(zone)
+	if err != nil {
+		return false, err
+	}
+	items, err := p.prepareAppend(zone, []libdns.Record{{Type: "TXT", Name: name, Value: value}})
+	if err != nil {
+		return false, err
+	}
+	items[0].acc = contextAccount(ctx, items[0].acc)
+	published, err := p.publishedValues(ctx, items[0].acc)
+	var dnsErr *net.DNSError
+	if err != nil && !(errors.As(err, &dnsErr) && dnsErr.IsNotFound) {
+		return false, err
+	}
+	for _, publishedValue := range published {
+		if publishedValue == items[0].value {
+			return false, nil
+		}
+	}
+	err = p.appendGroup(ctx, zone, "ensure", items, make([]*libdns.Record, 1))
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
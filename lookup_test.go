@@ -0,0 +1,319 @@
+package acmedns
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeResolver serves TXT values from memory.
+type fakeResolver struct {
+	txt   map[string][]string
+	errs  map[string]error
+	delay time.Duration
+}
+
+func (r *fakeResolver) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	if r.delay > 0 {
+		select {
+		case <-time.After(r.delay):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	if err, found := r.errs[name]; found {
+		return nil, err
+	}
+	return r.txt[name], nil
+}
+
+func TestGetAllRecords(t *testing.T) {
+	lookupErr := errors.New("no such host")
+	p := Provider{
+		Configs: map[string]DomainConfig{
+			"example.com":      {FullDomain: "a.auth.example.org"},
+			"sub.example.com":  {FullDomain: "b.auth.example.org"},
+			"broken.com":       {FullDomain: "c.auth.example.org"},
+			"nofulldomain.com": {},
+		},
+		Resolver: &fakeResolver{
+			txt: map[string][]string{
+				"a.auth.example.org": {"value1"},
+				"b.auth.example.org": {"value2", "value3"},
+			},
+			errs: map[string]error{"c.auth.example.org": lookupErr},
+		},
+	}
+
+	results, err := p.GetAllRecords(context.TODO())
+	var domainErrs DomainErrors
+	if !errors.As(err, &domainErrs) {
+		t.Fatalf("Expected DomainErrors, got %v", err)
+	}
+	if len(domainErrs) != 1 || !errors.Is(domainErrs["broken.com"], lookupErr) {
+		t.Fatalf("Unexpected errors %v", domainErrs)
+	}
+	if len(results) != 2 {
+		t.Fatalf("Expected results for 2 domains, got %v", results)
+	}
+	if len(results["example.com"]) != 1 || results["example.com"][0].Value != "value1" {
+		t.Fatalf("Unexpected records %v", results["example.com"])
+	}
+	if len(results["sub.example.com"]) != 2 {
+		t.Fatalf("Unexpected records %v", results["sub.example.com"])
+	}
+	if results["example.com"][0].Type != "TXT" || results["example.com"][0].Name != "_acme-challenge" || results["example.com"][0].ID != "a.auth.example.org" {
+		t.Fatalf("Unexpected record %v", results["example.com"][0])
+	}
+}
+
+func TestDiff(t *testing.T) {
+	tests := []struct {
+		published      []string
+		desired        []string
+		missing, extra []string
+	}{
+		{published: nil, desired: []string{"a"}, missing: []string{"a"}},
+		{published: []string{"a"}, desired: []string{"a"}},
+		{published: []string{"a", "b"}, desired: []string{"b"}, extra: []string{"a"}},
+		{published: []string{"a", "b"}, desired: []string{"b", "c"}, missing: []string{"c"}, extra: []string{"a"}},
+		{published: []string{"a", "b"}, desired: []string{"c", "d"}, missing: []string{"c", "d"}, extra: []string{"a", "b"}},
+		{published: []string{"a"}, desired: nil, extra: []string{"a"}},
+	}
+	for _, test := range tests {
+		p := Provider{
+			Configs:  map[string]DomainConfig{"example.com": {FullDomain: "a.auth.example.org"}},
+			Resolver: &fakeResolver{txt: map[string][]string{"a.auth.example.org": test.published}},
+		}
+		missing, extra, err := p.Diff(context.TODO(), "example.com.", "_acme-challenge", test.desired)
+		if err != nil {
+			t.Fatal("Diff failed: ", err)
+		}
+		if !reflect.DeepEqual(missing, test.missing) || !reflect.DeepEqual(extra, test.extra) {
+			t.Fatalf("Diff(%v, %v) = %v, %v; expected %v, %v",
+				test.published, test.desired, missing, extra, test.missing, test.extra)
+		}
+	}
+}
+
+func TestDiffWithoutFullDomain(t *testing.T) {
+	p := Provider{
+		Configs:  map[string]DomainConfig{"example.com": {}},
+		Resolver: &fakeResolver{},
+	}
+	_, _, err := p.Diff(context.TODO(), "example.com.", "_acme-challenge", []string{"a"})
+	if err == nil {
+		t.Fatal("Expected an error for account without FullDomain")
+	}
+}
+
+func TestLookupTimeout(t *testing.T) {
+	p := Provider{
+		Configs:    map[string]DomainConfig{"example.com": {FullDomain: "a.auth.example.org"}},
+		Resolver:   &fakeResolver{delay: time.Second},
+		DNSTimeout: 10 * time.Millisecond,
+	}
+	_, _, err := p.Diff(context.TODO(), "example.com.", "_acme-challenge", []string{"a"})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Expected lookup to time out, got: %v", err)
+	}
+}
+
+func TestDeriveFullDomain(t *testing.T) {
+	tests := []struct {
+		fullDomain, subdomain, serverURL string
+		expected                         string
+	}{
+		{fullDomain: "explicit.example.org", subdomain: "sub", serverURL: "https://auth.acme-dns.io", expected: "explicit.example.org"},
+		{subdomain: "sub", serverURL: "https://auth.acme-dns.io", expected: "sub.auth.acme-dns.io"},
+		{subdomain: "sub", serverURL: "https://auth.acme-dns.io:8443/api", expected: "sub.auth.acme-dns.io"},
+		{subdomain: "sub", serverURL: "https://127.0.0.1:8443"},
+		{serverURL: "https://auth.acme-dns.io"},
+	}
+	for _, test := range tests {
+		fullDomain := deriveFullDomain(test.fullDomain, test.subdomain, test.serverURL)
+		if fullDomain != test.expected {
+			t.Fatalf("deriveFullDomain(%q, %q, %q) = %q, expected %q",
+				test.fullDomain, test.subdomain, test.serverURL, fullDomain, test.expected)
+		}
+	}
+}
+
+func TestDiffWithDerivedFullDomain(t *testing.T) {
+	p := Provider{
+		Username:  "user",
+		Password:  "password",
+		Subdomain: "sub",
+		ServerURL: "https://auth.acme-dns.io",
+		Resolver:  &fakeResolver{txt: map[string][]string{"sub.auth.acme-dns.io": {"a"}}},
+	}
+	missing, _, err := p.Diff(context.TODO(), "example.com.", "_acme-challenge", []string{"a"})
+	if err != nil {
+		t.Fatal("Diff failed: ", err)
+	}
+	if len(missing) != 0 {
+		t.Fatalf("Expected value published at derived FullDomain, missing %v", missing)
+	}
+}
+
+func TestLookupCancelled(t *testing.T) {
+	p := Provider{
+		Configs:  map[string]DomainConfig{"example.com": {FullDomain: "a.auth.example.org"}},
+		Resolver: &fakeResolver{delay: 5 * time.Second},
+	}
+	ctx, cancel := context.WithCancel(context.TODO())
+	time.AfterFunc(10*time.Millisecond, cancel)
+
+	start := time.Now()
+	_, err := p.GetAllRecords(ctx)
+	var domainErrs DomainErrors
+	if !errors.As(err, &domainErrs) || !errors.Is(domainErrs["example.com"], context.Canceled) {
+		t.Fatalf("Expected lookup to be cancelled, got: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("Lookup was cancelled too late, after %v", elapsed)
+	}
+}
+
+func TestDNSUseTCP(t *testing.T) {
+	if _, ok := (&Provider{}).resolver().(*net.Resolver); !ok {
+		t.Fatal("Expected the system resolver by default")
+	}
+	resolver, ok := (&Provider{DNSUseTCP: true}).resolver().(*net.Resolver)
+	if !ok || resolver.Dial == nil {
+		t.Fatal("Expected a resolver with a custom dialer")
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("Failed to listen: ", err)
+	}
+	defer listener.Close()
+	conn, err := resolver.Dial(context.TODO(), "udp", listener.Addr().String())
+	if err != nil {
+		t.Fatal("Failed to dial: ", err)
+	}
+	defer conn.Close()
+	if network := conn.RemoteAddr().Network(); network != "tcp" {
+		t.Fatalf("Expected a TCP connection, got %s", network)
+	}
+}
+
+func TestEnsureRecord(t *testing.T) {
+	srv := newMockServer(t)
+	config := srv.newDomainConfig()
+	p := Provider{
+		Configs:  map[string]DomainConfig{"example.com": config},
+		Resolver: srv,
+	}
+
+	changed, err := p.EnsureRecord(context.TODO(), "example.com.", "_acme-challenge", "value")
+	if err != nil {
+		t.Fatal("Failed to ensure absent record: ", err)
+	}
+	if !changed || len(srv.requests) != 1 {
+		t.Fatalf("Expected an update for absent record, got changed %v and %d requests", changed, len(srv.requests))
+	}
+
+	changed, err = p.EnsureRecord(context.TODO(), "example.com.", "_acme-challenge", "value")
+	if err != nil {
+		t.Fatal("Failed to ensure present record: ", err)
+	}
+	if changed || len(srv.requests) != 1 {
+		t.Fatalf("Expected no update for present record, got changed %v and %d requests", changed, len(srv.requests))
+	}
+}
+
+func TestEnsureRecordPushesLikeAppendRecords(t *testing.T) {
+	srv := newMockServer(t)
+	config := srv.newDomainConfig()
+	p := Provider{
+		Configs:             map[string]DomainConfig{"example.com": config},
+		Resolver:            srv,
+		StrictTXTValidation: true,
+		DoublePush:          true,
+	}
+	_, err := p.EnsureRecord(context.TODO(), "example.com.", "_acme-challenge", "short")
+	if ErrorCode(err) != CodeBadTXT || len(srv.requests) != 0 {
+		t.Fatalf("Expected strict validation to reject the value, got %v and %d requests", err, len(srv.requests))
+	}
+	value := strings.Repeat("a", challengeLength)
+	changed, err := p.EnsureRecord(context.TODO(), "example.com.", "_acme-challenge", value)
+	if err != nil || !changed {
+		t.Fatalf("Failed to ensure record: %v, %v", changed, err)
+	}
+	if records := srv.records(config); len(srv.requests) != 2 || !reflect.DeepEqual(records, []string{value, value}) {
+		t.Fatalf("Expected the value to be pushed twice, got %v after %d requests", records, len(srv.requests))
+	}
+}
+
+func TestEnsureRecordNotFound(t *testing.T) {
+	srv := newMockServer(t)
+	config := srv.newDomainConfig()
+	p := Provider{
+		Configs:  map[string]DomainConfig{"example.com": config},
+		Resolver: &fakeResolver{errs: map[string]error{config.FullDomain: &net.DNSError{IsNotFound: true}}},
+	}
+	changed, err := p.EnsureRecord(context.TODO(), "example.com.", "_acme-challenge", "value")
+	if err != nil || !changed {
+		t.Fatalf("Expected an update for nonexistent domain, got changed %v and %v", changed, err)
+	}
+}
+
+// concurrencyResolver serves the value "value" after a delay and tracks
+// the maximum number of lookups in flight.
+type concurrencyResolver struct {
+	mu       sync.Mutex
+	inFlight int
+	max      int
+}
+
+func (r *concurrencyResolver) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	r.mu.Lock()
+	r.inFlight++
+	if r.inFlight > r.max {
+		r.max = r.inFlight
+	}
+	r.mu.Unlock()
+	time.Sleep(5 * time.Millisecond)
+	r.mu.Lock()
+	r.inFlight--
+	r.mu.Unlock()
+	return []string{"value"}, nil
+}
+
+func TestMaxConcurrentLookups(t *testing.T) {
+	configs := map[string]DomainConfig{}
+	want := map[string]string{}
+	for i := 0; i < 20; i++ {
+		domain := fmt.Sprintf("d%d.example.com", i)
+		configs[domain] = DomainConfig{FullDomain: fmt.Sprintf("d%d.auth.example.org", i)}
+		want["_acme-challenge."+domain] = "value"
+	}
+	for _, test := range []struct{ limit, expected int }{{0, 8}, {3, 3}} {
+		resolver := &concurrencyResolver{}
+		p := Provider{Configs: configs, Resolver: resolver, MaxConcurrentLookups: test.limit}
+		results, err := p.GetAllRecords(context.TODO())
+		if err != nil || len(results) != 20 {
+			t.Fatalf("Limit %d: unexpected results %v, %v", test.limit, results, err)
+		}
+		if resolver.max > test.expected {
+			t.Fatalf("Limit %d: expected at most %d concurrent lookups, got %d", test.limit, test.expected, resolver.max)
+		}
+
+		resolver.max = 0
+		err = p.WaitForAll(context.TODO(), want, time.Second)
+		if err != nil {
+			t.Fatalf("Limit %d: failed to wait: %v", test.limit, err)
+		}
+		if resolver.max > test.expected {
+			t.Fatalf("Limit %d: expected at most %d concurrent lookups while waiting, got %d", test.limit, test.expected, resolver.max)
+		}
+	}
+}
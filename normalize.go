@@ -0,0 +1,158 @@
+package acmedns
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/libdns/libdns"
+)
+
+// Maximum length of a domain name label in bytes.
+const maxLabelLength = 63
+
+// NormalizeDomain returns the domain a Configs entry is looked up by for
+// the record name in zone: the absolute record name, without surrounding
+// dots, in lowercase, with internationalized labels punycode-encoded and
+// with the "_acme-challenge." prefix removed. A name with a trailing dot
+// is treated as already fully qualified.
+//
+// For example, name "_acme-challenge.Sub" in zone "example.com." and
+// name "_acme-challenge.sub.example.com." both become "sub.example.com".
+func NormalizeDomain(zone, name string) (string, error) {
+	domain, err := normalizeName(zone, name)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimPrefix(domain, acmePrefix), nil
+}
+
+// normalizeName is NormalizeDomain without removing the challenge prefix.
+func normalizeName(zone, name string) (string, error) {
+	fqdn := name
+	if !strings.HasSuffix(name, ".") {
+		fqdn = libdns.AbsoluteName(name, zone)
+	}
+	if !utf8.ValidString(fqdn) {
+		return "", fmt.Errorf("Domain %q is not valid UTF-8", fqdn)
+	}
+	domain := strings.ToLower(strings.Trim(fqdn, "."))
+	if domain == "" {
+		return "", fmt.Errorf("Domain of record %q in zone %q is empty", name, zone)
+	}
+	labels := strings.Split(domain, ".")
+	for i, label := range labels {
+		if label == "" {
+			return "", fmt.Errorf("Domain %q has an empty label", domain)
+		}
+		if utf8.RuneCountInString(label) > maxLabelLength {
+			return "", fmt.Errorf("Domain %q has a label longer than %d characters", domain, maxLabelLength)
+		}
+		if !isASCII(label) {
+			label = "xn--" + encodePunycode(label)
+			if len(label) > maxLabelLength {
+				return "", fmt.Errorf("Domain %q has a label longer than %d characters when encoded", domain, maxLabelLength)
+			}
+			labels[i] = label
+		}
+	}
+	return strings.Join(labels, "."), nil
+}
+
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
+
+// Punycode parameters from RFC 3492.
+const (
+	punyBase        = 36
+	punyTMin        = 1
+	punyTMax        = 26
+	punySkew        = 38
+	punyDamp        = 700
+	punyInitialBias = 72
+	punyInitialN    = 128
+)
+
+// encodePunycode encodes s using the Punycode algorithm of RFC 3492.
+func encodePunycode(s string) string {
+	runes := []rune(s)
+	var out strings.Builder
+	for _, r := range runes {
+		if r < utf8.RuneSelf {
+			out.WriteRune(r)
+		}
+	}
+	basic := out.Len()
+	handled := basic
+	if basic > 0 {
+		out.WriteByte('-')
+	}
+	n, delta, bias := rune(punyInitialN), 0, punyInitialBias
+	for handled < len(runes) {
+		m := rune(utf8.MaxRune)
+		for _, r := range runes {
+			if r >= n && r < m {
+				m = r
+			}
+		}
+		delta += int(m-n) * (handled + 1)
+		n = m
+		for _, r := range runes {
+			if r < n {
+				delta++
+			}
+			if r != n {
+				continue
+			}
+			q := delta
+			for k := punyBase; ; k += punyBase {
+				t := k - bias
+				if t < punyTMin {
+					t = punyTMin
+				} else if t > punyTMax {
+					t = punyTMax
+				}
+				if q < t {
+					break
+				}
+				out.WriteByte(punyDigit(t + (q-t)%(punyBase-t)))
+				q = (q - t) / (punyBase - t)
+			}
+			out.WriteByte(punyDigit(q))
+			bias = punyAdapt(delta, handled+1, handled == basic)
+			delta = 0
+			handled++
+		}
+		delta++
+		n++
+	}
+	return out.String()
+}
+
+func punyDigit(d int) byte {
+	if d < 26 {
+		return byte('a' + d)
+	}
+	return byte('0' + d - 26)
+}
+
+func punyAdapt(delta, numPoints int, first bool) int {
+	if first {
+		delta /= punyDamp
+	} else {
+		delta /= 2
+	}
+	delta += delta / numPoints
+	k := 0
+	for delta > ((punyBase-punyTMin)*punyTMax)/2 {
+		delta /= punyBase - punyTMin
+		k += punyBase
+	}
+	return k + (punyBase-punyTMin+1)*delta/(delta+punySkew)
+}
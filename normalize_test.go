@@ -0,0 +1,75 @@
+package acmedns
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestNormalizeDomain(t *testing.T) {
+	tests := []struct {
+		zone, name string
+		expected   string
+		fails      bool
+	}{
+		{zone: "example.com.", name: "_acme-challenge", expected: "example.com"},
+		{zone: "example.com", name: "_acme-challenge", expected: "example.com"},
+		{zone: "example.com.", name: "_acme-challenge.sub", expected: "sub.example.com"},
+		{zone: "example.com.", name: "_acme-challenge.sub.example.com.", expected: "sub.example.com"},
+		{zone: "Example.COM.", name: "_ACME-Challenge.Sub", expected: "sub.example.com"},
+		{zone: "example.com.", name: "", expected: "example.com"},
+		{zone: "example.com.", name: "@", expected: "example.com"},
+		{zone: "example.com.", name: "other", expected: "other.example.com"},
+		{zone: "", name: "_acme-challenge.example.com", expected: "example.com"},
+		{zone: "münchen.de.", name: "_acme-challenge", expected: "xn--mnchen-3ya.de"},
+		{zone: "example.com.", name: "_acme-challenge.bücher", expected: "xn--bcher-kva.example.com"},
+		{zone: "españa.com.", name: "_acme-challenge", expected: "xn--espaa-rta.com"},
+		{zone: "", name: "", fails: true},
+		{zone: ".", name: "", fails: true},
+		{zone: "example..com.", name: "_acme-challenge", fails: true},
+		{zone: "example.com.", name: strings.Repeat("a", 64), fails: true},
+		{zone: "example.com.", name: "\xff", fails: true},
+	}
+	for _, test := range tests {
+		domain, err := NormalizeDomain(test.zone, test.name)
+		if test.fails {
+			if err == nil {
+				t.Fatalf("NormalizeDomain(%q, %q) = %q, expected an error", test.zone, test.name, domain)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("NormalizeDomain(%q, %q) failed: %v", test.zone, test.name, err)
+		}
+		if domain != test.expected {
+			t.Fatalf("NormalizeDomain(%q, %q) = %q, expected %q", test.zone, test.name, domain, test.expected)
+		}
+	}
+}
+
+func FuzzNormalizeDomain(f *testing.F) {
+	f.Add("example.com.", "_acme-challenge")
+	f.Add("example.com.", "_acme-challenge.sub.example.com.")
+	f.Add("münchen.de.", "_acme-challenge.Sub")
+	f.Add("", "")
+	f.Fuzz(func(t *testing.T, zone, name string) {
+		domain, err := NormalizeDomain(zone, name)
+		if err != nil {
+			return
+		}
+		if domain == "" || strings.HasPrefix(domain, ".") || strings.HasSuffix(domain, ".") {
+			t.Fatalf("NormalizeDomain(%q, %q) = %q has surrounding dots", zone, name, domain)
+		}
+		if !isASCII(domain) || strings.ToLower(domain) != domain {
+			t.Fatalf("NormalizeDomain(%q, %q) = %q is not lowercase ASCII", zone, name, domain)
+		}
+		for _, label := range strings.Split(domain, ".") {
+			if label == "" || len(label) > maxLabelLength {
+				t.Fatalf("NormalizeDomain(%q, %q) = %q has invalid label %q", zone, name, domain, label)
+			}
+		}
+		again, err := normalizeName("", domain)
+		if err != nil || again != domain {
+			t.Fatalf("Normalizing %q again gave %q, %v", domain, again, err)
+		}
+	})
+}
@@ -0,0 +1,123 @@
+package acmedns
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Default interval between TXT lookups of WaitForAll.
+const defaultPollInterval = 2 * time.Second
+
+// Default time to wait for a value to be published after an update.
+const defaultVerifyTimeout = 10 * time.Second
+
+// WaitForAll waits until every challenge value of want is published.
+// Keys of want are fully-qualified challenge record names, e.g.
+// "_acme-challenge.example.com", and values the expected TXT values.
+// For each name, the account is selected as for AppendRecords and its
+// FullDomain, or the name itself if VerifyTarget is "public", is polled
+// every PollInterval, all names concurrently.
+//
+// If timeout passes first, the returned error lists names whose values
+// are still missing.
+func (p *Provider) WaitForAll(ctx context.Context, want map[string]string, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	lookupNames := map[string]string{}
+	for name := range want {
+		acc, err := p.selectFQDN(name)
+		if err != nil {
+			return err
+		}
+		lookupNames[name], err = p.verifyName(*acc, name)
+		if err != nil {
+			return err
+		}
+	}
+
+	var mu sync.Mutex
+	var missing []string
+	var wg sync.WaitGroup
+	for name, value := range want {
+		wg.Add(1)
+		go func(name, value string) {
+			defer wg.Done()
+			if !p.waitFor(ctx, lookupNames[name], value) {
+				mu.Lock()
+				missing = append(missing, name)
+				mu.Unlock()
+			}
+		}(name, value)
+	}
+	wg.Wait()
+	if len(missing) > 0 {
+		sort.Strings(missing)
+		return fmt.Errorf("Challenge values of %s were not published in time: %w", strings.Join(missing, ", "), ctx.Err())
+	}
+	return nil
+}
+
+// verifyName returns the name looked up to verify that a value of acc is
+// published, according to VerifyTarget. publicName is the fully-qualified
+// challenge record name in the zone.
+func (p *Provider) verifyName(acc account, publicName string) (string, error) {
+	switch p.VerifyTarget {
+	case "", "fulldomain":
+		if acc.FullDomain == "" {
+			return "", fmt.Errorf("FullDomain of the account for domain %s is unknown, cannot verify update", acc.Domain)
+		}
+		return acc.FullDomain, nil
+	case "public":
+		return strings.TrimSuffix(publicName, ".") + ".", nil
+	default:
+		return "", fmt.Errorf("Unknown verify target %q", p.VerifyTarget)
+	}
+}
+
+// verifyPublished waits up to VerifyTimeout for value to be published
+// for acc. publicName is the fully-qualified challenge record name.
+func (p *Provider) verifyPublished(ctx context.Context, acc account, publicName, value string) error {
+	name, err := p.verifyName(acc, publicName)
+	if err != nil {
+		return err
+	}
+	timeout := p.VerifyTimeout
+	if timeout == 0 {
+		timeout = defaultVerifyTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	if !p.waitFor(ctx, name, value) {
+		return fmt.Errorf("Updated TXT value of domain %s was not published at %s: %w", acc.Domain, name, ctx.Err())
+	}
+	return nil
+}
+
+// waitFor polls TXT records of fqdn until value is published, and
+// reports whether it was before ctx was done.
+func (p *Provider) waitFor(ctx context.Context, fqdn, value string) bool {
+	interval := p.PollInterval
+	if interval == 0 {
+		interval = defaultPollInterval
+	}
+	for {
+		records, err := p.lookupTXT(ctx, fqdn)
+		if err == nil {
+			for _, record := range records {
+				if record.Value == value {
+					return true
+				}
+			}
+		}
+		select {
+		case <-time.After(interval):
+		case <-ctx.Done():
+			return false
+		}
+	}
+}
@@ -0,0 +1,237 @@
+package acmedns
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/libdns/libdns"
+)
+
+// staggeredResolver publishes values of names after per-name delays.
+type staggeredResolver struct {
+	start  time.Time
+	delays map[string]time.Duration
+	values map[string]string
+}
+
+func (r *staggeredResolver) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	if time.Since(r.start) < r.delays[name] {
+		return nil, nil
+	}
+	return []string{r.values[name]}, nil
+}
+
+func newStaggeredProvider(delays map[string]time.Duration) *Provider {
+	values := map[string]string{}
+	for name := range delays {
+		values[name] = "value-" + name
+	}
+	return &Provider{
+		Configs: map[string]DomainConfig{
+			"a.example.com": {FullDomain: "a.auth.example.org"},
+			"b.example.com": {FullDomain: "b.auth.example.org"},
+			"c.example.com": {FullDomain: "c.auth.example.org"},
+		},
+		Resolver: &staggeredResolver{
+			start:  time.Now(),
+			delays: delays,
+			values: values,
+		},
+		PollInterval: 5 * time.Millisecond,
+	}
+}
+
+func TestWaitForAll(t *testing.T) {
+	p := newStaggeredProvider(map[string]time.Duration{
+		"a.auth.example.org": 0,
+		"b.auth.example.org": 20 * time.Millisecond,
+		"c.auth.example.org": 40 * time.Millisecond,
+	})
+	err := p.WaitForAll(context.TODO(), map[string]string{
+		"_acme-challenge.a.example.com": "value-a.auth.example.org",
+		"_acme-challenge.b.example.com": "value-b.auth.example.org",
+		"_acme-challenge.c.example.com": "value-c.auth.example.org",
+	}, 5*time.Second)
+	if err != nil {
+		t.Fatal("Waiting for propagation failed: ", err)
+	}
+}
+
+func TestWaitForAllWithNestedConfigs(t *testing.T) {
+	p := newStaggeredProvider(map[string]time.Duration{
+		"a.auth.example.org": 0,
+		"n.auth.example.org": 20 * time.Millisecond,
+	})
+	p.NestedConfigs = map[string]map[string]DomainConfig{
+		"example.com": {"_acme-challenge.b": {FullDomain: "n.auth.example.org"}},
+	}
+	err := p.WaitForAll(context.TODO(), map[string]string{
+		"_acme-challenge.a.example.com": "value-a.auth.example.org",
+		"_acme-challenge.b.example.com": "value-n.auth.example.org",
+	}, 5*time.Second)
+	if err != nil {
+		t.Fatal("Waiting for propagation failed: ", err)
+	}
+}
+
+func TestWaitForAllTimeout(t *testing.T) {
+	p := newStaggeredProvider(map[string]time.Duration{
+		"a.auth.example.org": 0,
+		"b.auth.example.org": time.Hour,
+		"c.auth.example.org": time.Hour,
+	})
+	err := p.WaitForAll(context.TODO(), map[string]string{
+		"_acme-challenge.a.example.com": "value-a.auth.example.org",
+		"_acme-challenge.b.example.com": "value-b.auth.example.org",
+		"_acme-challenge.c.example.com": "value-c.auth.example.org",
+	}, 50*time.Millisecond)
+	if err == nil {
+		t.Fatal("Expected waiting for propagation to time out")
+	}
+	msg := err.Error()
+	if strings.Contains(msg, "a.example.com") || !strings.Contains(msg, "_acme-challenge.b.example.com, _acme-challenge.c.example.com") {
+		t.Fatalf("Unexpected missing names in error: %v", err)
+	}
+}
+
+// laggingResolver returns no values for the first lookups, then
+// delegates to resolver.
+type laggingResolver struct {
+	resolver TXTResolver
+	lag      int
+	lookups  int
+}
+
+func (r *laggingResolver) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	r.lookups++
+	if r.lookups <= r.lag {
+		return nil, nil
+	}
+	return r.resolver.LookupTXT(ctx, name)
+}
+
+func TestVerifyAfterUpdate(t *testing.T) {
+	srv := newMockServer(t)
+	resolver := &laggingResolver{resolver: srv, lag: 2}
+	p := Provider{
+		Configs:           map[string]DomainConfig{"example.com": srv.newDomainConfig()},
+		Resolver:          resolver,
+		PollInterval:      time.Millisecond,
+		VerifyAfterUpdate: true,
+	}
+	_, err := p.AppendRecords(context.TODO(), "example.com", []libdns.Record{makeRecord("value")})
+	if err != nil {
+		t.Fatal("Failed to append verified record: ", err)
+	}
+	if resolver.lookups != 3 {
+		t.Fatalf("Expected 3 lookups, got %d", resolver.lookups)
+	}
+}
+
+func TestVerifyAfterUpdateTimeout(t *testing.T) {
+	srv := newMockServer(t)
+	p := Provider{
+		Configs:           map[string]DomainConfig{"example.com": srv.newDomainConfig()},
+		Resolver:          &fakeResolver{},
+		PollInterval:      time.Millisecond,
+		VerifyAfterUpdate: true,
+		VerifyTimeout:     20 * time.Millisecond,
+	}
+	appended, err := p.AppendRecords(context.TODO(), "example.com", []libdns.Record{makeRecord("value")})
+	if err == nil || !strings.Contains(err.Error(), "not published") {
+		t.Fatalf("Expected a verification error, got %v", err)
+	}
+	if len(appended) != 0 {
+		t.Fatalf("Unverified record must not be returned, got %v", appended)
+	}
+}
+
+// cnameResolver follows CNAME records to TXT values served by resolver,
+// as a recursive resolver does for delegated challenge records.
+type cnameResolver struct {
+	cnames   map[string]string
+	resolver TXTResolver
+	lookups  []string
+}
+
+func (r *cnameResolver) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	r.lookups = append(r.lookups, name)
+	name = strings.TrimSuffix(name, ".")
+	if target, found := r.cnames[name]; found {
+		name = target
+	}
+	return r.resolver.LookupTXT(ctx, name)
+}
+
+func TestVerifyTarget(t *testing.T) {
+	tests := []struct {
+		target    string
+		delegated bool
+		lookup    string
+		fails     bool
+	}{
+		{target: "", delegated: true, lookup: "subdomain1.auth.example.org"},
+		{target: "fulldomain", delegated: false, lookup: "subdomain1.auth.example.org"},
+		{target: "public", delegated: true, lookup: "_acme-challenge.example.com."},
+		{target: "public", delegated: false, lookup: "_acme-challenge.example.com.", fails: true},
+		{target: "unknown", delegated: true, fails: true},
+	}
+	for _, test := range tests {
+		srv := newMockServer(t)
+		config := srv.newDomainConfig()
+		resolver := &cnameResolver{cnames: map[string]string{}, resolver: srv}
+		if test.delegated {
+			resolver.cnames["_acme-challenge.example.com"] = config.FullDomain
+		}
+		p := Provider{
+			Configs:           map[string]DomainConfig{"example.com": config},
+			Resolver:          resolver,
+			PollInterval:      time.Millisecond,
+			VerifyAfterUpdate: true,
+			VerifyTimeout:     20 * time.Millisecond,
+			VerifyTarget:      test.target,
+		}
+		_, err := p.AppendRecords(context.TODO(), "example.com.", []libdns.Record{makeRecord("value")})
+		if (err != nil) != test.fails {
+			t.Fatalf("Target %q, delegated %v: unexpected result %v", test.target, test.delegated, err)
+		}
+		if test.lookup != "" && (len(resolver.lookups) == 0 || resolver.lookups[0] != test.lookup) {
+			t.Fatalf("Target %q: expected lookups of %s, got %v", test.target, test.lookup, resolver.lookups)
+		}
+	}
+}
+
+func TestVerifyCheckedBeforeUpdate(t *testing.T) {
+	srv := newMockServer(t)
+	withoutFullDomain := srv.newDomainConfig()
+	withoutFullDomain.FullDomain = ""
+	tests := []struct {
+		target string
+		config DomainConfig
+	}{
+		{target: "bogus", config: srv.newDomainConfig()},
+		{target: "fulldomain", config: withoutFullDomain},
+	}
+	for _, test := range tests {
+		p := Provider{
+			Configs:           map[string]DomainConfig{"example.com": test.config},
+			Resolver:          &fakeResolver{},
+			VerifyAfterUpdate: true,
+			VerifyTarget:      test.target,
+		}
+		_, err := p.AppendRecords(context.TODO(), "example.com.", []libdns.Record{makeRecord("value")})
+		if err == nil {
+			t.Fatalf("Target %q: expected an error", test.target)
+		}
+		if len(srv.requests) != 0 {
+			t.Fatalf("Target %q: expected no requests before verification is possible, got %d", test.target, len(srv.requests))
+		}
+	}
+
+	p := Provider{Configs: map[string]DomainConfig{"example.com": srv.newDomainConfig()}, VerifyTarget: "bogus"}
+	if err := p.Validate(); err == nil {
+		t.Fatal("Expected Validate to reject an unknown verify target")
+	}
+}
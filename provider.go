@@ -4,8 +4,14 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
 	"net/http"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/libdns/libdns"
@@ -13,18 +19,81 @@ import (
 
 var acmePrefix = "_acme-challenge."
 
+// ErrUnauthorized is returned when ACME-DNS rejects account credentials.
+var ErrUnauthorized = errors.New("ACME-DNS rejected account credentials")
+
 type DomainConfig struct {
 	Username   string `json:"username,omitempty"`
 	Password   string `json:"password,omitempty"`
 	Subdomain  string `json:"subdomain,omitempty"`
 	FullDomain string `json:"fulldomain,omitempty"`
 	ServerURL  string `json:"server_url,omitempty"`
+
+	// CIDR ranges the account accepts updates from, as registered with
+	// ACME-DNS. Checked client-side only if Provider.CheckAllowFrom is set.
+	AllowFrom []string `json:"allowfrom,omitempty"`
+}
+
+// domainConfigJSON holds every DomainConfig field name accepted when
+// decoding, including the legacy ones. See also ConfigSchema.
+type domainConfigJSON struct {
+	Username         string   `json:"username"`
+	Password         string   `json:"password"`
+	Subdomain        string   `json:"subdomain"`
+	FullDomain       string   `json:"fulldomain"`
+	LegacyFullDomain string   `json:"full_domain"`
+	ServerURL        string   `json:"server_url"`
+	LegacyServerURL  string   `json:"serverurl"`
+	AllowFrom        []string `json:"allowfrom"`
+}
+
+// UnmarshalJSON decodes DomainConfig, also accepting "full_domain"
+// and "serverurl" field names used by older acme-dns-client versions.
+// Surrounding whitespace is trimmed from credentials.
+func (c *DomainConfig) UnmarshalJSON(data []byte) error {
+	var raw domainConfigJSON
+	err := json.Unmarshal(data, &raw)
+	if err != nil {
+		return err
+	}
+	*c = DomainConfig{
+		Username:   strings.TrimSpace(raw.Username),
+		Password:   strings.TrimSpace(raw.Password),
+		Subdomain:  strings.TrimSpace(raw.Subdomain),
+		FullDomain: raw.FullDomain,
+		ServerURL:  raw.ServerURL,
+		AllowFrom:  raw.AllowFrom,
+	}
+	if c.FullDomain == "" {
+		c.FullDomain = raw.LegacyFullDomain
+	}
+	if c.ServerURL == "" {
+		c.ServerURL = raw.LegacyServerURL
+	}
+	return nil
+}
+
+// ParseRegistration parses an ACME-DNS account registration, as returned
+// by ACME-DNS API /register endpoint and printed by acme-dns-client, into
+// DomainConfig. Unknown fields are ignored. ServerURL
+// is not part of the registration and has to be set by the caller.
+func ParseRegistration(r io.Reader) (DomainConfig, error) {
+	var config DomainConfig
+	err := json.NewDecoder(r).Decode(&config)
+	if err != nil {
+		return DomainConfig{}, fmt.Errorf("Error while unmarshalling registration: %w", err)
+	}
+	if config.Username == "" || config.Password == "" || config.Subdomain == "" {
+		return DomainConfig{}, fmt.Errorf("Registration must contain username, password and subdomain")
+	}
+	return config, nil
 }
 
 // Provider must be set up in one of two ways:
 //
 // 1) Set Configs field. Configs field defines a map from domains
-// to different ACME-DNS accounts.
+// to different ACME-DNS accounts. NestedConfigs can be set instead of,
+// or in addition to, Configs.
 //
 // 2) Set fields Username, Password, Subdomain, ServerURL.
 // If these fields are set, one account will be used for
@@ -33,8 +102,26 @@ type Provider struct {
 	// Provider.Configs defines a map from domain string to
 	// DomainConfig. It uses the same structure as ACME-DNS client
 	// JSON storage file (https://github.com/acme-dns/acme-dns-client).
+	// Keys are matched after normalization, see NormalizeDomain, so
+	// their case and encoding do not matter.
 	Configs map[string]DomainConfig `json:"config,omitempty"`
 
+	// Provider.NestedConfigs defines a map from zone to a map from
+	// record name (relative to the zone, e.g. "_acme-challenge.sub") to
+	// DomainConfig. Zones and names are keyed in lowercase, without
+	// trailing dots; record names are normalized as for Configs before
+	// the lookup. The "" name holds the default account of the zone.
+	// It takes precedence over Configs: the exact record name is tried
+	// first, then the zone default, and if neither is found the account
+	// is selected from Configs or the single-account fields as usual.
+	NestedConfigs map[string]map[string]DomainConfig `json:"nested_configs,omitempty"`
+
+	// Controls how LoadConfigEnv merges configs of domains already in
+	// Configs. With "last-wins" (the default), loaded configs replace
+	// existing ones. With "first-wins", existing configs are kept. With
+	// "error", loading fails and Configs is left unchanged.
+	MergePolicy string `json:"merge_policy,omitempty"`
+
 	// ACME-DNS account username as returned by ACME-DNS API /register endpoint.
 	Username string `json:"username,omitempty"`
 
@@ -46,81 +133,985 @@ type Provider struct {
 
 	// ACME-DNS API base URL. For example, https://auth.acme-dns.io
 	ServerURL string `json:"server_url,omitempty"`
+
+	// Paths of files holding Username, Password, Subdomain and
+	// ServerURL, such as Docker or Kubernetes secret mounts. They are
+	// read by LoadCredentialFiles.
+	UsernameFile  string `json:"username_file,omitempty"`
+	PasswordFile  string `json:"password_file,omitempty"`
+	SubdomainFile string `json:"subdomain_file,omitempty"`
+	ServerURLFile string `json:"server_url_file,omitempty"`
+
+	// If true, AppendRecords rejects TXT values that are not exactly
+	// 43 characters long, the length of an ACME DNS-01 challenge
+	// (base64url-encoded SHA-256 digest). Defaults to false, so
+	// accounts can also be used to publish arbitrary TXT values.
+	StrictTXTValidation bool `json:"strict_txt_validation,omitempty"`
+
+	// Optional hook returning the ACME-DNS username and API key to use
+	// for an update of the given domain. It is called right before each
+	// request is sent and, when set, overrides the static credentials,
+	// so rotated keys are picked up without recreating the Provider.
+	CredentialProvider func(ctx context.Context, domain string) (user, key string, err error) `json:"-"`
+
+	// Resolver used to look up published TXT records. Defaults to
+	// net.DefaultResolver.
+	Resolver TXTResolver `json:"-"`
+
+	// DNS-over-HTTPS JSON API endpoint used to look up published TXT
+	// records when Resolver is not set. For example,
+	// https://cloudflare-dns.com/dns-query. Useful where the system
+	// resolver or port 53 is unavailable.
+	DoHEndpoint string `json:"doh_endpoint,omitempty"`
+
+	// Timeout of each TXT record lookup. Defaults to 5 seconds.
+	DNSTimeout time.Duration `json:"dns_timeout,omitempty"`
+
+	// If true, TXT record lookups done with the system resolver use TCP
+	// instead of UDP, avoiding truncated responses for large TXT sets.
+	// It has no effect when Resolver or DoHEndpoint is set.
+	DNSUseTCP bool `json:"dns_use_tcp,omitempty"`
+
+	// Maximum number of TXT record lookups in flight at a time, across
+	// WaitForAll, GetAllRecords and other lookups of this Provider.
+	// Defaults to 8. A negative value means no limit.
+	MaxConcurrentLookups int `json:"max_concurrent_lookups,omitempty"`
+
+	// Interval between TXT record lookups while waiting for challenge
+	// values to propagate. Defaults to 2 seconds.
+	PollInterval time.Duration `json:"poll_interval,omitempty"`
+
+	// If true, AppendRecords looks up each value after updating it and
+	// fails unless the value is published within VerifyTimeout. Lookups
+	// are repeated every PollInterval and use the same resolver as
+	// WaitForAll. See VerifyTarget for the name looked up.
+	VerifyAfterUpdate bool `json:"verify_after_update,omitempty"`
+
+	// Maximum time AppendRecords waits for an updated value to be
+	// published when VerifyAfterUpdate is set. Defaults to 10 seconds.
+	VerifyTimeout time.Duration `json:"verify_timeout,omitempty"`
+
+	// Name looked up to verify published values, by VerifyAfterUpdate
+	// and WaitForAll. With "fulldomain" (the default), the FullDomain of
+	// the account at the ACME-DNS server is queried. With "public", the
+	// challenge record name in the zone is queried, which also checks
+	// the CNAME delegation to the ACME-DNS server.
+	VerifyTarget string `json:"verify_target,omitempty"`
+
+	// Optional hook called after every use of ACME-DNS account
+	// credentials. It can be used to keep an audit log.
+	AuditHook func(AuditEvent) `json:"-"`
+
+	// Optional hook called after every update request, including
+	// retried ones, with the domain of the account, the server URL, the
+	// response status code (0 if no response was received) and the
+	// error, nil on success. It never receives credentials or TXT values.
+	DebugHook func(domain, serverURL string, status int, err error) `json:"-"`
+
+	// If true, phases of every update request are timed with
+	// net/http/httptrace and reported to TimingHook, which must be set.
+	TraceTiming bool `json:"trace_timing,omitempty"`
+
+	// Hook receiving timing of update requests when TraceTiming is set.
+	// It is called for failed requests too.
+	TimingHook func(domain, serverURL string, timing RequestTiming) `json:"-"`
+
+	// If true, the Date header of update responses is compared to the
+	// local clock, and a *ClockSkewWarning is reported when they differ
+	// by more than ClockSkewThreshold. Skew does not affect ACME-DNS
+	// itself, but helps to diagnose TLS and rate-limiting problems.
+	WarnOnClockSkew bool `json:"warn_on_clock_skew,omitempty"`
+
+	// Clock difference reported by WarnOnClockSkew. Defaults to 1 minute.
+	ClockSkewThreshold time.Duration `json:"clock_skew_threshold,omitempty"`
+
+	// Optional hook receiving warnings, such as *ClockSkewWarning, which
+	// do not make an operation fail. Defaults to logging them with the
+	// standard logger.
+	WarningHook func(warning error) `json:"-"`
+
+	// Controls how Configs keys are looked up. With "stripped" (the
+	// default) the "_acme-challenge." prefix is removed from the record
+	// domain, so configs are keyed by e.g. "example.com". With "raw"
+	// configs are keyed by the full record domain, e.g.
+	// "_acme-challenge.example.com".
+	ConfigKeyMode string `json:"config_key_mode,omitempty"`
+
+	// If greater than zero, this number of leading labels is removed
+	// from the record domain to get the Configs key, instead of the
+	// "_acme-challenge." prefix. For example, with 2 the account of
+	// "_acme-challenge.sub.example.com" is looked up as "example.com".
+	// It takes precedence over ConfigKeyMode.
+	StripLabels int `json:"strip_labels,omitempty"`
+
+	// HTTP method of update requests: POST, PUT or PATCH.
+	// Defaults to POST, as expected by ACME-DNS.
+	UpdateMethod string `json:"update_method,omitempty"`
+
+	// Host name used to verify the ACME-DNS server certificate and sent
+	// as TLS SNI. Needed when ServerURL host, e.g. an IP address, is not
+	// the name the certificate was issued for.
+	TLSServerName string `json:"tls_server_name,omitempty"`
+
+	// Hex-encoded SHA-256 fingerprint of the ACME-DNS server certificate,
+	// optionally with colons between bytes. If set, only a server
+	// presenting this exact certificate is accepted, which allows using
+	// self-signed certificates without disabling verification.
+	PinnedCertSHA256 string `json:"pinned_cert_sha256,omitempty"`
+
+	// Minimum TLS version accepted from ACME-DNS servers, e.g.
+	// tls.VersionTLS13. Defaults to TLS 1.2.
+	MinTLSVersion uint16 `json:"min_tls_version,omitempty"`
+
+	// How long idle keep-alive connections to ACME-DNS servers are kept
+	// open. Set it below the server's keep-alive timeout to avoid
+	// reusing connections the server is about to close. Defaults to the
+	// 90 seconds of http.DefaultTransport.
+	IdleConnTimeout time.Duration `json:"idle_conn_timeout,omitempty"`
+
+	// If set, AppendRecords called with a context without a deadline
+	// applies this timeout to the whole call.
+	DefaultTimeout time.Duration `json:"default_timeout,omitempty"`
+
+	// Codec used to encode and decode ACME-DNS API bodies.
+	// Defaults to encoding/json.
+	Codec Codec `json:"-"`
+
+	// Optional function returning the body of update requests for the
+	// selected account and TXT value, for ACME-DNS forks expecting a
+	// different schema. When set, Codec is not used to encode requests.
+	// Credential headers are still set as usual, and the body is still
+	// compressed if CompressRequests is set.
+	UpdateBodyFunc func(config DomainConfig, value string) ([]byte, error) `json:"-"`
+
+	// Controls behavior of GetRecords: "error" (the default) returns
+	// an error, "empty" returns no records, "resolve" looks up TXT
+	// records currently published for the zone's account in DNS and
+	// "cname" returns the "_acme-challenge" CNAME record that should
+	// delegate the zone's challenges to the account's FullDomain.
+	GetRecordsMode string `json:"get_records_mode,omitempty"`
+
+	// If true, GetRecords in "resolve" mode falls back to the values
+	// last pushed through this Provider when the DNS lookup fails.
+	// These values may be stale: they do not reflect updates made by
+	// other clients and are lost when the process restarts.
+	GetRecordsFallbackToHistory bool `json:"get_records_fallback_to_history,omitempty"`
+
+	// If true, update request bodies are gzip-compressed and sent with
+	// "Content-Encoding: gzip". Only enable for servers known to
+	// support it; stock ACME-DNS does not.
+	CompressRequests bool `json:"compress_requests,omitempty"`
+
+	// Optional hook called with every /update response, before its
+	// status is checked. The hook may read the body, it receives its
+	// own copy, but must not close it.
+	ResponseHook func(*http.Response) `json:"-"`
+
+	// HTTP response codes of /update treated as success.
+	// Defaults to 200 only.
+	ExpectedStatus []int `json:"expected_status,omitempty"`
+
+	// Optional predicate deciding whether an /update response means
+	// success, e.g. by inspecting the body. When set, ExpectedStatus is
+	// not used. The predicate may read the body but must not close it.
+	SuccessFunc func(*http.Response) bool `json:"-"`
+
+	// Optional hook called when a value pushed through this Provider is
+	// rolled out of the ACME-DNS window of RollingWindowSize values by
+	// a newer push. It is best-effort, based on values pushed within
+	// this process.
+	WindowEvictionHook func(zone, name, evictedValue string) `json:"-"`
+
+	// Number of TXT values the ACME-DNS server keeps per account. Stock
+	// ACME-DNS keeps two, the default. Set it for forks with a different
+	// window. It is used by the value history, WindowEvictionHook and
+	// DoublePush.
+	RollingWindowSize int `json:"rolling_window_size,omitempty"`
+
+	// If true, AppendRecords pushes every value RollingWindowSize times
+	// in a row (twice with stock ACME-DNS), so all slots of the window
+	// hold it and it survives later pushes, e.g. stale retries. This
+	// leaves room for a single value: when several values must be
+	// published for the same account at once, as for a wildcard and its
+	// base domain sharing an account, only the last one remains.
+	DoublePush bool `json:"double_push,omitempty"`
+
+	// Content-Type header of update requests.
+	// Defaults to application/json.
+	ContentType string `json:"content_type,omitempty"`
+
+	// Timeout of each update request, replacing the default HTTP client
+	// timeout of 30 seconds. Retried requests get the full timeout again.
+	UpdateTimeout time.Duration `json:"update_timeout,omitempty"`
+
+	// If ForwardedForValue is set, it is sent in the ForwardedForHeader
+	// header (X-Forwarded-For by default) of update requests. ACME-DNS
+	// checks it against account allowfrom ranges only when configured
+	// with use_header. Such a server trusts whatever the client sends,
+	// so it should only be reachable through a proxy that sets the
+	// header itself.
+	ForwardedForHeader string `json:"forwarded_for_header,omitempty"`
+	ForwardedForValue  string `json:"forwarded_for_value,omitempty"`
+
+	// Appended to the User-Agent header of requests to ACME-DNS servers,
+	// e.g. "myapp/1.2". The library identifier is always kept.
+	UserAgentSuffix string `json:"user_agent_suffix,omitempty"`
+
+	// If true, the ETag returned by an update is sent in the If-Match
+	// header of the next update of the same account, and a 412 response
+	// is returned as *ConflictError. This is supported only by ACME-DNS
+	// forks implementing optimistic concurrency, not by stock servers.
+	ConditionalUpdates bool `json:"conditional_updates,omitempty"`
+
+	// Policy deciding whether and when failed update requests are
+	// retried. Defaults to NoRetry.
+	RetryPolicy RetryPolicy `json:"-"`
+
+	// Maximum number of records accepted by a single AppendRecords call.
+	// Larger batches are rejected before any request is sent. Zero means
+	// no limit.
+	MaxRecordsPerCall int `json:"max_records_per_call,omitempty"`
+
+	// If true, AppendRecords skips records other than TXT instead of
+	// failing, and updates the TXT records of the call. Skipped records
+	// are not returned.
+	SkipNonTXT bool `json:"skip_non_txt,omitempty"`
+
+	// If true, AppendRecords, GetRecords, Diff and EnsureRecord accept
+	// an empty zone and treat record names as fully-qualified domain
+	// names, e.g. "_acme-challenge.example.com". If false, they return
+	// an error for an empty zone.
+	AllowEmptyZone bool `json:"allow_empty_zone,omitempty"`
+
+	// If true, a record name ending with the zone but without a trailing
+	// dot, e.g. "_acme-challenge.sub.example.com" in zone "example.com",
+	// is treated as fully qualified instead of relative to the zone, so
+	// it selects the same account as "_acme-challenge.sub".
+	RelativizeNames bool `json:"relativize_names,omitempty"`
+
+	// If true, AppendRecords updates records of different ACME-DNS
+	// servers concurrently. Records of the same server are still
+	// updated one at a time, in order. If updates fail on several
+	// servers, errors are combined as set by ErrorAggregation. Hooks
+	// may then be called concurrently.
+	ParallelServers bool `json:"parallel_servers,omitempty"`
+
+	// Maximum number of update requests sent to the same ACME-DNS server
+	// at a time, across all concurrent calls on this Provider. Requests
+	// over the limit wait for a free slot. Zero means no limit.
+	PerServerConcurrency int `json:"per_server_concurrency,omitempty"`
+
+	// Controls the error AppendRecords returns when updates fail on
+	// several servers with ParallelServers. With "multi" (the default),
+	// a *MultiError holding every failure is returned; it works with
+	// errors.Is and errors.As like errors.Join, which requires Go 1.20.
+	// With "first", only the error of the server listed first is
+	// returned.
+	ErrorAggregation string `json:"error_aggregation,omitempty"`
+
+	// If true, the local egress IP address, or ForwardedForValue if set,
+	// is checked against the account's DomainConfig.AllowFrom ranges
+	// before each update, so updates the server would reject fail with
+	// a descriptive error. Accounts without AllowFrom ranges are not
+	// checked.
+	CheckAllowFrom bool `json:"check_allow_from,omitempty"`
+
+	// Optional function returning the local IP address used to reach
+	// the ACME-DNS server at serverURL. Defaults to the source address
+	// the operating system picks for a UDP socket connected to the
+	// server host. Addresses translated by NAT are not detected.
+	EgressIP func(ctx context.Context, serverURL string) (net.IP, error) `json:"-"`
+
+	// Mutable state, created on first use. It is kept behind a pointer
+	// so Provider can be copied; copies made after first use share it.
+	state *providerState
 }
 
-type account struct {
-	Username  string
-	Password  string
-	Subdomain string
+// providerState holds caches and limiters shared by all calls on
+// a Provider.
+type providerState struct {
+	history     valueHistory
+	etags       etagStore
+	transports  transportCache
+	serverSlots keyedLimiter
+	lookupSlots keyedLimiter
+}
+
+// stateMu guards lazy creation of Provider.state.
+var stateMu sync.Mutex
+
+func (p *Provider) st() *providerState {
+	stateMu.Lock()
+	defer stateMu.Unlock()
+	if p.state == nil {
+		p.state = &providerState{}
+	}
+	return p.state
+}
+
+// Reset clears in-memory state kept by Provider, e.g. after the
+// configuration of the ACME-DNS accounts changed elsewhere: the history
+// of pushed values, ETags of conditional updates and the cached HTTP
+// transport, whose idle connections are closed. Requests in flight keep
+// their slots of PerServerConcurrency and MaxConcurrentLookups.
+func (p *Provider) Reset() {
+	state := p.st()
+	state.history.reset()
+	state.etags.reset()
+	state.transports.reset()
+}
+
+// ConflictError is returned by conditional updates rejected because the
+// account TXT values were changed since ETag was obtained.
+type ConflictError struct {
+	Domain string
+	ETag   string
+}
+
+func (e *ConflictError) Error() string {
+	return fmt.Sprintf("ACME-DNS account for domain %s was modified concurrently, ETag %s is outdated", e.Domain, e.ETag)
+}
+
+// Code returns CodeConflict.
+func (e *ConflictError) Code() string {
+	return CodeConflict
+}
+
+// Codec encodes and decodes ACME-DNS API request and response bodies.
+type Codec interface {
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Marshal(v interface{}) ([]byte, error)      { return json.Marshal(v) }
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error { return json.Unmarshal(data, v) }
+
+func (p *Provider) codec() Codec {
+	if p.Codec != nil {
+		return p.Codec
+	}
+	return jsonCodec{}
+}
+
+// AuditEvent describes one use of ACME-DNS account credentials.
+// It never contains passwords or TXT values.
+type AuditEvent struct {
+	Time      time.Time
+	Operation string // "append", "ensure" or "test"
+	Domain    string
 	ServerURL string
+	Err       error // nil if the operation succeeded
+}
+
+func (p *Provider) audit(operation string, acc account, err error) {
+	if p.AuditHook == nil {
+		return
+	}
+	p.AuditHook(AuditEvent{
+		Time:      time.Now(),
+		Operation: operation,
+		Domain:    acc.Domain,
+		ServerURL: acc.ServerURL,
+		Err:       err,
+	})
+}
+
+// Length of a DNS-01 challenge value as defined by RFC 8555.
+const challengeLength = 43
+
+type account struct {
+	Domain     string
+	Username   string
+	Password   string
+	Subdomain  string
+	FullDomain string
+	ServerURL  string
+	AllowFrom  []string
+}
+
+func (acc account) config() DomainConfig {
+	return DomainConfig{
+		Username:   acc.Username,
+		Password:   acc.Password,
+		Subdomain:  acc.Subdomain,
+		FullDomain: acc.FullDomain,
+		ServerURL:  acc.ServerURL,
+		AllowFrom:  acc.AllowFrom,
+	}
+}
+
+// configKey returns the domain used to look up the account of
+// a record in Provider.Configs. See NormalizeDomain.
+func (p *Provider) configKey(zone string, name string) (string, error) {
+	domain, err := normalizeName(zone, name)
+	if err != nil {
+		return "", err
+	}
+	if p.StripLabels < 0 {
+		return "", fmt.Errorf("StripLabels cannot be negative")
+	}
+	if p.StripLabels > 0 {
+		labels := strings.Split(domain, ".")
+		if len(labels) <= p.StripLabels {
+			return "", fmt.Errorf("Cannot strip %d labels from domain %s", p.StripLabels, domain)
+		}
+		return strings.Join(labels[p.StripLabels:], "."), nil
+	}
+	switch p.ConfigKeyMode {
+	case "", "stripped":
+		// Same as NormalizeDomain, without normalizing again.
+		return strings.TrimPrefix(domain, acmePrefix), nil
+	case "raw":
+		return domain, nil
+	default:
+		return "", fmt.Errorf("Unknown config key mode %q", p.ConfigKeyMode)
+	}
+}
+
+// configAccount returns the account of config. Surrounding whitespace,
+// common in credentials pasted from elsewhere, is trimmed.
+func configAccount(domain string, config DomainConfig) *account {
+	subdomain := strings.TrimSpace(config.Subdomain)
+	return &account{
+		Domain:     domain,
+		Username:   strings.TrimSpace(config.Username),
+		Password:   strings.TrimSpace(config.Password),
+		Subdomain:  subdomain,
+		FullDomain: deriveFullDomain(config.FullDomain, subdomain, config.ServerURL),
+		ServerURL:  config.ServerURL,
+		AllowFrom:  config.AllowFrom,
+	}
+}
+
+// relativize strips zone from the end of name if RelativizeNames is set.
+// Names with a trailing dot are already treated as fully qualified.
+func (p *Provider) relativize(zone, name string) string {
+	zone = strings.Trim(zone, ".")
+	if !p.RelativizeNames || zone == "" || strings.HasSuffix(name, ".") {
+		return name
+	}
+	if strings.EqualFold(name, zone) {
+		return "@"
+	}
+	prefix := len(name) - len(zone) - 1
+	if prefix > 0 && name[prefix] == '.' && strings.EqualFold(name[prefix+1:], zone) {
+		return name[:prefix]
+	}
+	return name
 }
 
 func (p *Provider) selectAccount(zone string, name string) (*account, error) {
-	if p.Configs != nil {
-		domain := name + "." + zone
-		if domain[len(domain)-1:] == "." {
-			domain = domain[:len(domain)-1]
+	name = p.relativize(zone, name)
+	if len(p.Configs) == 0 && len(p.NestedConfigs) == 0 {
+		// The single account is used whatever the record, so the name
+		// is not normalized. It is only reported as the domain of the
+		// account, to hooks and in errors.
+		domain := strings.TrimPrefix(strings.Trim(libdns.AbsoluteName(name, zone), "."), acmePrefix)
+		return p.singleAccount(domain)
+	}
+	domain, err := p.configKey(zone, name)
+	if err != nil {
+		return nil, err
+	}
+	config, found, err := p.nestedConfig(zone, name)
+	if err != nil {
+		return nil, err
+	}
+	if found {
+		return configAccount(domain, config), nil
+	}
+	if len(p.Configs) > 0 {
+		config, found := p.configFor(domain)
+		if !found {
+			return nil, withCode(CodeConfigNotFound, fmt.Errorf("Config for domain %s not found", domain))
 		}
-		if domain[:len(acmePrefix)] == acmePrefix {
-			domain = domain[len(acmePrefix):]
+		return configAccount(domain, config), nil
+	}
+
+	return p.singleAccount(domain)
+}
+
+// configFor returns the Configs entry of domain, a normalized config key.
+// Keys are matched as written first, then normalized as record domains
+// are, so keys such as "Example.com" or "bücher.de" are found too. If
+// several keys normalize to domain, the smallest one is used.
+func (p *Provider) configFor(domain string) (DomainConfig, bool) {
+	if config, found := p.Configs[domain]; found {
+		return config, true
+	}
+	var match string
+	found := false
+	for key := range p.Configs {
+		normalized, err := normalizeName("", key)
+		if err == nil && normalized == domain && (!found || key < match) {
+			match, found = key, true
 		}
-		config, found := p.Configs[domain]
-		if !found {
-			return nil, fmt.Errorf("Config for domain %s not found", domain)
+	}
+	if !found {
+		return DomainConfig{}, false
+	}
+	return p.Configs[match], true
+}
+
+// nestedConfig returns the NestedConfigs entry of a record, if any. The
+// record name is normalized as for Configs and made relative to the
+// zone, so fully-qualified and mixed-case names find their entry.
+func (p *Provider) nestedConfig(zone, name string) (DomainConfig, bool, error) {
+	zoneKey := strings.ToLower(strings.Trim(zone, "."))
+	names, found := p.NestedConfigs[zone]
+	if !found {
+		names, found = p.NestedConfigs[zoneKey]
+	}
+	if !found {
+		return DomainConfig{}, false, nil
+	}
+	relative, err := normalizeName(zone, name)
+	if err != nil {
+		return DomainConfig{}, false, err
+	}
+	if zoneKey != "" {
+		zoneName, err := normalizeName(zone, "@")
+		if err != nil {
+			return DomainConfig{}, false, err
 		}
-		acc := account{
-			Username:  config.Username,
-			Password:  config.Password,
-			Subdomain: config.Subdomain,
-			ServerURL: config.ServerURL,
+		if relative == zoneName {
+			relative = "@"
+		} else {
+			relative = strings.TrimSuffix(relative, "."+zoneName)
 		}
-		return &acc, nil
 	}
+	config, found := names[relative]
+	if !found {
+		config, found = names[""]
+	}
+	return config, found, nil
+}
 
-	if p.Username == "" {
-		return nil, fmt.Errorf("Username cannot be empty")
+// singleAccount returns the account of the single-account fields.
+func (p *Provider) singleAccount(domain string) (*account, error) {
+	err := p.checkAccountFields()
+	if err != nil {
+		return nil, err
 	}
-	if p.Password == "" {
-		return nil, fmt.Errorf("Password cannot be empty")
+	return configAccount(domain, DomainConfig{
+		Username:  p.Username,
+		Password:  p.Password,
+		Subdomain: p.Subdomain,
+		ServerURL: p.ServerURL,
+	}), nil
+}
+
+// AccountForFQDN returns the account used for the fully-qualified
+// challenge record name fqdn, e.g. "_acme-challenge.sub.example.com.",
+// for callers that do not split it into zone and record name. The name
+// is normalized with NormalizeDomain and matched as by AppendRecords.
+// FullDomain of the returned config is derived if it is not set.
+func (p *Provider) AccountForFQDN(fqdn string) (DomainConfig, error) {
+	acc, err := p.selectFQDN(fqdn)
+	if err != nil {
+		return DomainConfig{}, err
+	}
+	return acc.config(), nil
+}
+
+// selectFQDN returns the account for the fully-qualified name fqdn,
+// looked up in the NestedConfigs zone it belongs to.
+func (p *Provider) selectFQDN(fqdn string) (*account, error) {
+	return p.selectAccount(p.zoneOf(fqdn), strings.TrimSuffix(fqdn, ".")+".")
+}
+
+// zoneOf returns the NestedConfigs zone that fqdn equals or is a
+// subdomain of, the longest one if several match, or "" if none does.
+func (p *Provider) zoneOf(fqdn string) string {
+	name, err := normalizeName("", fqdn)
+	if err != nil {
+		return ""
+	}
+	match := ""
+	matchName := ""
+	for zone := range p.NestedConfigs {
+		zoneName, err := normalizeName(zone, "@")
+		if err != nil || zoneName == "" {
+			continue
+		}
+		if name != zoneName && !strings.HasSuffix(name, "."+zoneName) {
+			continue
+		}
+		if len(zoneName) > len(matchName) {
+			match, matchName = zone, zoneName
+		}
+	}
+	return match
+}
+
+// checkZone returns an error for an empty zone unless AllowEmptyZone
+// is set.
+func (p *Provider) checkZone(zone string) error {
+	if strings.Trim(zone, ".") == "" && !p.AllowEmptyZone {
+		return fmt.Errorf("Zone cannot be empty, set AllowEmptyZone to pass fully-qualified record names")
+	}
+	return nil
+}
+
+// checkAccountFields checks that the single-account fields are set.
+// Credentials are checked after trimming, as they are used.
+func (p *Provider) checkAccountFields() error {
+	if strings.TrimSpace(p.Username) == "" {
+		return withCode(CodeMissingCredentials, fmt.Errorf("Username cannot be empty"))
 	}
-	if p.Subdomain == "" {
-		return nil, fmt.Errorf("Subdomain cannot be empty")
+	if strings.TrimSpace(p.Password) == "" {
+		return withCode(CodeMissingCredentials, fmt.Errorf("Password cannot be empty"))
+	}
+	if strings.TrimSpace(p.Subdomain) == "" {
+		return withCode(CodeMissingCredentials, fmt.Errorf("Subdomain cannot be empty"))
 	}
 	if p.ServerURL == "" {
-		return nil, fmt.Errorf("ServerURL cannot be empty")
+		return withCode(CodeMissingCredentials, fmt.Errorf("ServerURL cannot be empty"))
 	}
+	return nil
+}
 
-	acc := account{
+// ToConfigs moves the single-account credentials into Configs entries
+// of the given domains and clears the single-account fields, so more
+// domains can be configured with different accounts afterwards. Domains
+// are normalized like Configs keys are looked up. If any domain is
+// invalid or already configured, the Provider is left unchanged.
+func (p *Provider) ToConfigs(domains []string) error {
+	err := p.checkAccountFields()
+	if err != nil {
+		return err
+	}
+	if len(domains) == 0 {
+		return fmt.Errorf("At least one domain must be given")
+	}
+	config := DomainConfig{
 		Username:  p.Username,
 		Password:  p.Password,
 		Subdomain: p.Subdomain,
 		ServerURL: p.ServerURL,
 	}
-	return &acc, nil
+	// Configs is only changed once all domains are checked.
+	configs := map[string]DomainConfig{}
+	for _, domain := range domains {
+		domain, err := normalizeName("", domain)
+		if err != nil {
+			return err
+		}
+		if _, found := p.Configs[domain]; found {
+			return fmt.Errorf("Config for domain %s already exists", domain)
+		}
+		if _, found := configs[domain]; found {
+			return fmt.Errorf("Domain %s is given more than once", domain)
+		}
+		configs[domain] = config
+	}
+	if p.Configs == nil {
+		p.Configs = map[string]DomainConfig{}
+	}
+	for domain, config := range configs {
+		p.Configs[domain] = config
+	}
+	p.Username, p.Password, p.Subdomain, p.ServerURL = "", "", "", ""
+	return nil
+}
+
+// Validate checks that Provider is set up in one of the supported ways,
+// with Configs, NestedConfigs or the single-account fields, and that all
+// server URLs include the http:// or https:// scheme.
+func (p *Provider) Validate() error {
+	switch p.VerifyTarget {
+	case "", "fulldomain", "public":
+	default:
+		return fmt.Errorf("Unknown verify target %q", p.VerifyTarget)
+	}
+	if configs := p.allConfigs(); len(configs) > 0 {
+		for domain, config := range configs {
+			err := checkServerURL(config.ServerURL)
+			if err != nil {
+				return fmt.Errorf("Config for domain %s: %w", domain, err)
+			}
+		}
+		return nil
+	}
+	err := p.checkAccountFields()
+	if err != nil {
+		return err
+	}
+	return checkServerURL(p.ServerURL)
+}
+
+// responseCopy returns a copy of resp reading the already consumed body.
+func responseCopy(resp *http.Response, body []byte) *http.Response {
+	c := *resp
+	c.Body = ioutil.NopCloser(bytes.NewReader(body))
+	return &c
+}
+
+func (p *Provider) isExpectedStatus(status int) bool {
+	if len(p.ExpectedStatus) == 0 {
+		return status == http.StatusOK
+	}
+	for _, expected := range p.ExpectedStatus {
+		if status == expected {
+			return true
+		}
+	}
+	return false
+}
+
+// updateResponse is the body returned by ACME-DNS /update endpoint.
+// Older servers return an empty body, newer ones the TXT value and
+// possibly other fields of the updated account.
+type updateResponse struct {
+	Txt        string `json:"txt,omitempty"`
+	Subdomain  string `json:"subdomain,omitempty"`
+	FullDomain string `json:"fulldomain,omitempty"`
+}
+
+func (p *Provider) updateTxtValue(ctx context.Context, acc account, value string) (*updateResponse, error) {
+	if p.CheckAllowFrom {
+		err := p.checkAllowFrom(ctx, acc)
+		if err != nil {
+			return nil, err
+		}
+	}
+	req, err := p.newUpdateRequest(ctx, acc, value)
+	if err != nil {
+		return nil, err
+	}
+	policy := p.retryPolicy(ctx)
+	for attempt := 1; ; attempt++ {
+		release, err := p.st().serverSlots.acquire(ctx, acc.ServerURL, p.PerServerConcurrency)
+		if err != nil {
+			return nil, fmt.Errorf("Error while waiting to update ACME-DNS record: %w", err)
+		}
+		// UpdateTimeout applies to each attempt, not to the whole loop.
+		attemptCtx, cancel := ctx, context.CancelFunc(func() {})
+		if p.UpdateTimeout > 0 {
+			attemptCtx, cancel = context.WithTimeout(ctx, p.UpdateTimeout)
+		}
+		updated, resp, err := p.sendUpdate(attemptCtx, acc, req)
+		cancel()
+		release()
+		if p.DebugHook != nil {
+			status := 0
+			if resp != nil {
+				status = resp.StatusCode
+			}
+			p.DebugHook(acc.Domain, acc.ServerURL, status, err)
+		}
+		if err == nil {
+			return updated, nil
+		}
+		if ctx.Err() != nil {
+			return nil, err
+		}
+		delay, retry := policy.NextDelay(attempt, resp, err)
+		if !retry {
+			return nil, err
+		}
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return nil, err
+		}
+	}
+}
+
+// updateRequest holds the parts of an update request that are the same
+// for every attempt.
+type updateRequest struct {
+	method string
+	url    string
+	header http.Header
+	body   []byte
+}
+
+// newUpdateRequest returns the update request setting value for acc.
+func (p *Provider) newUpdateRequest(ctx context.Context, acc account, value string) (*updateRequest, error) {
+	body, err := p.updateBody(acc, value)
+	if err != nil {
+		return nil, err
+	}
+	if p.CompressRequests {
+		body, err = gzipBody(body)
+		if err != nil {
+			return nil, err
+		}
+	}
+	method := p.UpdateMethod
+	switch method {
+	case "":
+		method = http.MethodPost
+	case http.MethodPost, http.MethodPut, http.MethodPatch:
+	default:
+		return nil, fmt.Errorf("Unsupported update method %q", method)
+	}
+	updateURL, err := endpointURL(acc.ServerURL, "/update")
+	if err != nil {
+		return nil, err
+	}
+	header, err := p.updateHeader(ctx, acc)
+	if err != nil {
+		return nil, err
+	}
+	return &updateRequest{method: method, url: updateURL, header: header, body: body}, nil
 }
 
-func updateTxtValue(acc account, value string) error {
-	body, err := json.Marshal(
+// updateBody returns the body of an update request setting value.
+func (p *Provider) updateBody(acc account, value string) ([]byte, error) {
+	if p.UpdateBodyFunc != nil {
+		body, err := p.UpdateBodyFunc(acc.config(), value)
+		if err != nil {
+			return nil, fmt.Errorf("Error while building update request body: %w", err)
+		}
+		return body, nil
+	}
+	body, err := p.codec().Marshal(
 		map[string]string{
 			"subdomain": acc.Subdomain,
 			"txt":       value,
 		},
 	)
 	if err != nil {
-		return fmt.Errorf("Error while marshalling JSON: %w", err)
+		return nil, fmt.Errorf("Error while marshalling JSON: %w", err)
+	}
+	return body, nil
+}
+
+// updateHeader returns headers of update requests for acc.
+func (p *Provider) updateHeader(ctx context.Context, acc account) (http.Header, error) {
+	user, key := acc.Username, acc.Password
+	if p.CredentialProvider != nil {
+		var err error
+		user, key, err = p.CredentialProvider(ctx, acc.Domain)
+		if err != nil {
+			return nil, fmt.Errorf("Error while obtaining credentials for domain %s: %w", acc.Domain, err)
+		}
+	}
+	contentType := p.ContentType
+	if contentType == "" {
+		contentType = "application/json"
+	}
+	header := http.Header{}
+	header.Set("Content-Type", contentType)
+	header.Set("User-Agent", p.userAgent())
+	header.Set("Accept", "application/json")
+	if p.CompressRequests {
+		header.Set("Content-Encoding", "gzip")
+	}
+	if p.ForwardedForValue != "" {
+		name := p.ForwardedForHeader
+		if name == "" {
+			name = "X-Forwarded-For"
+		}
+		header.Set(name, p.ForwardedForValue)
+	}
+	header.Set("X-Api-User", user)
+	header.Set("X-Api-Key", key)
+	return header, nil
+}
+
+// sendUpdate sends one update request. The response, with its body
+// already consumed, is returned if received, even on error.
+func (p *Provider) sendUpdate(ctx context.Context, acc account, update *updateRequest) (*updateResponse, *http.Response, error) {
+	if p.TraceTiming && p.TimingHook != nil {
+		var trace *timingTrace
+		ctx, trace = withTimingTrace(ctx)
+		defer func() {
+			p.TimingHook(acc.Domain, acc.ServerURL, trace.done())
+		}()
+	}
+	req, err := http.NewRequestWithContext(ctx, update.method, update.url, bytes.NewBuffer(update.body))
+	if err != nil {
+		return nil, nil, fmt.Errorf("Error while creating request: %w", err)
+	}
+	req.Header = update.header.Clone()
+	if p.ConditionalUpdates {
+		if etag := p.st().etags.get(acc); etag != "" {
+			req.Header.Set("If-Match", etag)
+		}
+	}
+	client := p.httpClient()
+	if p.UpdateTimeout > 0 {
+		client.Timeout = p.UpdateTimeout
 	}
-	req, err := http.NewRequest("POST", acc.ServerURL+"/update", bytes.NewBuffer(body))
-	req.Header.Set("X-Api-User", acc.Username)
-	req.Header.Set("X-Api-Key", acc.Password)
-	client := &http.Client{Timeout: time.Second * 30}
 	resp, err := client.Do(req)
 	if err != nil {
-		return fmt.Errorf("Error while reading response: %w", err)
+		return nil, nil, fmt.Errorf("Error while reading response: %w", err)
 	}
-	if resp.StatusCode != 200 {
-		return fmt.Errorf("Updating ACME-DNS record resulted in response code %d", resp.StatusCode)
+	defer resp.Body.Close()
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, resp, fmt.Errorf("Error while reading response: %w", err)
 	}
-	return nil
+	if p.ResponseHook != nil {
+		p.ResponseHook(responseCopy(resp, respBody))
+	}
+	if p.WarnOnClockSkew {
+		p.checkClockSkew(acc.ServerURL, resp, time.Now())
+	}
+	if resp.StatusCode >= 300 && resp.StatusCode < 400 {
+		return nil, resp, withCode(CodeAPIError, fmt.Errorf("ACME-DNS server redirected to %q (response code %d), set ServerURL to the canonical server URL", resp.Header.Get("Location"), resp.StatusCode))
+	}
+	if resp.StatusCode == http.StatusUnauthorized {
+		return nil, resp, withCode(CodeUnauthorized, fmt.Errorf("Updating ACME-DNS record resulted in response code %d: %w", resp.StatusCode, ErrUnauthorized))
+	}
+	if p.ConditionalUpdates && resp.StatusCode == http.StatusPreconditionFailed {
+		// The conflict response reports the current ETag, if any, for
+		// the next update. Other error responses leave the stored one.
+		if etag := resp.Header.Get("ETag"); etag != "" {
+			p.st().etags.set(acc, etag)
+		}
+		return nil, resp, &ConflictError{Domain: acc.Domain, ETag: req.Header.Get("If-Match")}
+	}
+	if p.SuccessFunc != nil {
+		if !p.SuccessFunc(responseCopy(resp, respBody)) {
+			return nil, resp, withCode(CodeAPIError, fmt.Errorf("Updating ACME-DNS record failed according to SuccessFunc, response code %d", resp.StatusCode))
+		}
+	} else if !p.isExpectedStatus(resp.StatusCode) {
+		return nil, resp, withCode(CodeAPIError, fmt.Errorf("Updating ACME-DNS record resulted in response code %d", resp.StatusCode))
+	}
+	if p.ConditionalUpdates && resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		p.st().etags.set(acc, resp.Header.Get("ETag"))
+	}
+	var updated updateResponse
+	if len(bytes.TrimSpace(respBody)) > 0 {
+		err = p.codec().Unmarshal(respBody, &updated)
+		if err != nil {
+			return nil, resp, fmt.Errorf("Error while unmarshalling response: %w", err)
+		}
+	}
+	if updated.Subdomain != "" && updated.Subdomain != acc.Subdomain {
+		return nil, resp, withCode(CodeAPIError, fmt.Errorf("ACME-DNS account subdomain is %s, not %s: check that username, password and subdomain belong to the same account", updated.Subdomain, acc.Subdomain))
+	}
+	return &updated, resp, nil
+}
+
+// TestCredentials checks that ACME-DNS accepts credentials of cfg.
+//
+// ACME-DNS API has no dedicated authentication check, so an update with
+// an empty TXT value is sent. ACME-DNS authenticates the request first
+// and then rejects the value with response code 400, so published values
+// are not changed. If the credentials are wrong, the returned error
+// wraps ErrUnauthorized. A server accepting empty values, e.g. a fork,
+// would clear one value of the account's window.
+func (p *Provider) TestCredentials(ctx context.Context, cfg DomainConfig) (err error) {
+	acc := contextAccount(ctx, *configAccount(cfg.FullDomain, cfg))
+	defer func() {
+		p.audit("test", acc, err)
+	}()
+	req, err := p.newUpdateRequest(ctx, acc, "")
+	if err != nil {
+		return err
+	}
+	_, resp, err := p.sendUpdate(ctx, acc, req)
+	if resp != nil && resp.StatusCode == http.StatusBadRequest {
+		return nil
+	}
+	return err
 }
 
 // Implements libdns.RecordAppender.
@@ -128,34 +1119,157 @@ func updateTxtValue(acc account, value string) error {
 // The only operation Joohoi's ACME-DNS API supports is a rolling update
 // of two TXT records.
 //
-// If Provider Configs field is not nil, zone and record names are used to
+// If Provider Configs field is not empty, zone and record names are used to
 // select relevant credentials from Provider.Configs.
 //
-// If Configs is nil and Provider is set up with non-nil Username,
+// If Configs is empty and Provider is set up with non-empty Username,
 // Password, Subdomain and ServerURL fields, these credentials
 // will be used to update ACME-DNS account TXT records regardless
 // of what zone and record names are passed.
 //
-// Only TXT records are supported. ID, TTL and Priority fields
-// of libdns.Record are ignored.
+// All records are validated and their accounts selected before any
+// update is made. Records are then grouped by ACME-DNS server URL and
+// each group is pushed one record at a time, in the order given, so
+// connections are reused within a group. Groups are processed one after
+// another in the order of their first record, or concurrently if
+// ParallelServers is set. ACME-DNS keeps only the RollingWindowSize
+// (by default two) most recently pushed values of an account, so when
+// more records map to the same account, only the last ones remain.
+//
+// If ctx is done while records are being pushed, AppendRecords stops
+// before the next record and returns the records already pushed with
+// an error wrapping ctx.Err().
+//
+// Only TXT records are supported, see SkipNonTXT. ID, TTL and Priority
+// fields of libdns.Record are ignored. Leading and trailing whitespace is
+// trimmed from values, as it is usually a copy-paste error and
+// ACME-DNS rejects such values. If StrictTXTValidation is set,
+// values must have the length of a DNS-01 challenge.
+//
+// Names of returned records are fully qualified with a trailing dot,
+// normalized as by NormalizeDomain but keeping the "_acme-challenge"
+// label, e.g. "_acme-challenge.sub.example.com." for record name
+// "_acme-challenge.sub" in zone "example.com". They name the records in
+// the zone, not the CNAME targets at the ACME-DNS server.
 func (p *Provider) AppendRecords(ctx context.Context, zone string, recs []libdns.Record) ([]libdns.Record, error) {
+	if _, hasDeadline := ctx.Deadline(); !hasDeadline && p.DefaultTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, p.DefaultTimeout)
+		defer cancel()
+	}
+	if p.MaxRecordsPerCall > 0 && len(recs) > p.MaxRecordsPerCall {
+		return nil, fmt.Errorf("Cannot append %d records, at most %d are allowed per call", len(recs), p.MaxRecordsPerCall)
+	}
+	switch p.ErrorAggregation {
+	case "", "first", "multi":
+	default:
+		return nil, fmt.Errorf("Unknown error aggregation %q", p.ErrorAggregation)
+	}
+	err := p.checkZone(zone)
+	if err != nil {
+		return []libdns.Record{}, err
+	}
+	items, err := p.prepareAppend(zone, recs)
+	if err != nil {
+		return []libdns.Record{}, err
+	}
+	for i := range items {
+		items[i].acc = contextAccount(ctx, items[i].acc)
+	}
+	groups := groupByServer(items)
+	appended := make([]*libdns.Record, len(items))
+	errs := make([]error, len(groups))
+	if p.ParallelServers {
+		var wg sync.WaitGroup
+		for i, group := range groups {
+			wg.Add(1)
+			go func(i int, group []appendItem) {
+				defer wg.Done()
+				errs[i] = p.appendGroup(ctx, zone, "append", group, appended)
+			}(i, group)
+		}
+		wg.Wait()
+	} else {
+		for i, group := range groups {
+			errs[i] = p.appendGroup(ctx, zone, "append", group, appended)
+			if errs[i] != nil {
+				break
+			}
+		}
+	}
 	appendedRecords := []libdns.Record{}
-	for _, record := range recs {
-		if record.Type != "TXT" {
-			return appendedRecords, fmt.Errorf("joohoi_acme_dns provider only supports adding TXT records")
+	for _, record := range appended {
+		if record != nil {
+			appendedRecords = append(appendedRecords, *record)
 		}
-		acc, err := p.selectAccount(zone, record.Name)
+	}
+	var failures []error
+	for _, err := range errs {
+		if err != nil {
+			failures = append(failures, err)
+		}
+	}
+	switch {
+	case len(failures) == 0:
+		return appendedRecords, nil
+	case len(failures) > 1 && p.ErrorAggregation != "first":
+		return appendedRecords, &MultiError{errs: failures}
+	default:
+		return appendedRecords, failures[0]
+	}
+}
+
+// Implements libdns.RecordGetter.
+//
+// ACME-DNS API cannot list records, so by default GetRecords returns
+// an error. See Provider.GetRecordsMode for alternatives. In "resolve"
+// and "cname" modes, the account is selected as for the "_acme-challenge"
+// record of the zone and must have FullDomain set or derivable from
+// Subdomain and ServerURL. Records returned in "cname" mode are derived
+// from configuration only, they are not looked up.
+//
+// In "resolve" mode, the ID of each returned record is set to the
+// FullDomain of the account, e.g. "<subdomain>.auth.acme-dns.io", so
+// values can be correlated with accounts. The same holds for records
+// returned by GetAllRecords.
+func (p *Provider) GetRecords(ctx context.Context, zone string) ([]libdns.Record, error) {
+	err := p.checkZone(zone)
+	if err != nil {
+		return nil, err
+	}
+	switch p.GetRecordsMode {
+	case "", "error":
+		return nil, fmt.Errorf("joohoi_acme_dns provider does not support listing records")
+	case "empty":
+		return nil, nil
+	case "resolve":
+		acc, err := p.selectAccount(zone, strings.TrimSuffix(acmePrefix, "."))
 		if err != nil {
-			return appendedRecords, err
+			return nil, err
+		}
+		records, err := p.lookupAccount(ctx, *acc)
+		if err != nil && p.GetRecordsFallbackToHistory {
+			if values := p.st().history.get(*acc); len(values) > 0 {
+				return txtRecords(values, acc.FullDomain), nil
+			}
 		}
-		err = updateTxtValue(*acc, record.Value)
+		return records, err
+	case "cname":
+		acc, err := p.selectAccount(zone, strings.TrimSuffix(acmePrefix, "."))
 		if err != nil {
-			return appendedRecords, err
+			return nil, err
 		}
-		appendedRecords = append(appendedRecords, libdns.Record{Type: "TXT", Name: record.Name, Value: record.Value})
-
+		if acc.FullDomain == "" {
+			return nil, fmt.Errorf("FullDomain of the account for domain %s is unknown", acc.Domain)
+		}
+		return []libdns.Record{{
+			Type:  "CNAME",
+			Name:  strings.TrimSuffix(acmePrefix, "."),
+			Value: acc.FullDomain + ".",
+		}}, nil
+	default:
+		return nil, fmt.Errorf("Unknown GetRecords mode %q", p.GetRecordsMode)
 	}
-	return appendedRecords, nil
 }
 
 // Implements libdns.RecordDeleter.
@@ -169,6 +1283,7 @@ func (p *Provider) DeleteRecords(ctx context.Context, zone string, recs []libdns
 
 // Interface guards.
 var (
+	_ libdns.RecordGetter   = (*Provider)(nil)
 	_ libdns.RecordAppender = (*Provider)(nil)
 	_ libdns.RecordDeleter  = (*Provider)(nil)
 )
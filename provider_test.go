@@ -3,10 +3,19 @@ package acmedns
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io/ioutil"
 	"net"
 	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/libdns/libdns"
 )
@@ -47,6 +56,103 @@ func createDomainConfig(t *testing.T) DomainConfig {
 	}
 }
 
+// mockServer emulates the ACME-DNS /update endpoint, including the
+// rolling window of TXT values per account, two unless window is set.
+type mockServer struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	window   int
+	accounts map[string]DomainConfig
+	txt      map[string][]string
+	requests []*http.Request
+}
+
+func newMockServer(t *testing.T) *mockServer {
+	s := &mockServer{
+		accounts: map[string]DomainConfig{},
+		txt:      map[string][]string{},
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.handleUpdate))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *mockServer) handleUpdate(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.requests = append(s.requests, r)
+	if r.URL.Path != "/update" {
+		http.NotFound(w, r)
+		return
+	}
+	var body struct {
+		Subdomain string `json:"subdomain"`
+		Txt       string `json:"txt"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&body)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	acc, found := s.accounts[r.Header.Get("X-Api-User")]
+	if !found || acc.Password != r.Header.Get("X-Api-Key") || acc.Subdomain != body.Subdomain {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	if body.Txt == "" {
+		// ACME-DNS validates the value only after authentication.
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "bad_txt"})
+		return
+	}
+	window := s.window
+	if window == 0 {
+		window = 2
+	}
+	values := append(s.txt[acc.Subdomain], body.Txt)
+	if len(values) > window {
+		values = values[len(values)-window:]
+	}
+	s.txt[acc.Subdomain] = values
+	json.NewEncoder(w).Encode(map[string]string{"txt": body.Txt})
+}
+
+// newDomainConfig registers a new account on the mock server.
+func (s *mockServer) newDomainConfig() DomainConfig {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := strconv.Itoa(len(s.accounts) + 1)
+	config := DomainConfig{
+		Username:   "user" + n,
+		Password:   "password" + n,
+		Subdomain:  "subdomain" + n,
+		FullDomain: "subdomain" + n + ".auth.example.org",
+		ServerURL:  s.URL,
+	}
+	s.accounts[config.Username] = config
+	return config
+}
+
+// records returns the TXT values currently held for an account.
+func (s *mockServer) records(config DomainConfig) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.txt[config.Subdomain]...)
+}
+
+// LookupTXT serves TXT values held by the mock server by account FullDomain.
+func (s *mockServer) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, acc := range s.accounts {
+		if acc.FullDomain == name {
+			return append([]string(nil), s.txt[acc.Subdomain]...), nil
+		}
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+}
+
 func makeRecord(recordValue string) libdns.Record {
 	return libdns.Record{
 		Type:  "TXT",
@@ -158,3 +264,1197 @@ func TestAppendRecordsWithAccountConfig(t *testing.T) {
 		t.Fatalf("Expected record %s, not found in %v", value2, newRecords)
 	}
 }
+
+func TestAppendRecordsWithoutStrictTXTValidation(t *testing.T) {
+	srv := newMockServer(t)
+	p := Provider{Configs: map[string]DomainConfig{"example.com": srv.newDomainConfig()}}
+
+	_, err := p.AppendRecords(context.TODO(), "example.com", []libdns.Record{makeRecord("hello")})
+	if err != nil {
+		t.Fatal("Failed to append records: ", err)
+	}
+	records := srv.records(p.Configs["example.com"])
+	if len(records) != 1 || records[0] != "hello" {
+		t.Fatalf("Unexpected TXT records %v", records)
+	}
+
+	p.StrictTXTValidation = true
+	_, err = p.AppendRecords(context.TODO(), "example.com", []libdns.Record{makeRecord("hello")})
+	if err == nil {
+		t.Fatal("Expected short TXT value to be rejected")
+	}
+}
+
+func TestAppendRecordsWithCredentialProvider(t *testing.T) {
+	srv := newMockServer(t)
+	config := srv.newDomainConfig()
+	staleKey := config.Password
+	config.Password = "rotated"
+	srv.accounts[config.Username] = config
+
+	var gotDomain string
+	p := Provider{
+		Username:  config.Username,
+		Password:  staleKey,
+		Subdomain: config.Subdomain,
+		ServerURL: config.ServerURL,
+		CredentialProvider: func(ctx context.Context, domain string) (string, string, error) {
+			gotDomain = domain
+			return config.Username, "rotated", nil
+		},
+	}
+
+	_, err := p.AppendRecords(context.TODO(), "example.com", []libdns.Record{makeRecord("value")})
+	if err != nil {
+		t.Fatal("Failed to append records: ", err)
+	}
+	if gotDomain != "example.com" {
+		t.Fatalf("Unexpected domain %s passed to CredentialProvider", gotDomain)
+	}
+	if records := srv.records(config); len(records) != 1 {
+		t.Fatalf("Unexpected TXT records %v", records)
+	}
+}
+
+func TestUpdateSetsAcceptHeader(t *testing.T) {
+	srv := newMockServer(t)
+	p := Provider{Configs: map[string]DomainConfig{"example.com": srv.newDomainConfig()}}
+
+	_, err := p.AppendRecords(context.TODO(), "example.com", []libdns.Record{makeRecord("value")})
+	if err != nil {
+		t.Fatal("Failed to append records: ", err)
+	}
+	if accept := srv.requests[0].Header.Get("Accept"); accept != "application/json" {
+		t.Fatalf("Unexpected Accept header %q", accept)
+	}
+}
+
+func TestUpdateRedirectIsReported(t *testing.T) {
+	srv := newMockServer(t)
+	redirector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, srv.URL+r.URL.Path, http.StatusMovedPermanently)
+	}))
+	defer redirector.Close()
+	config := srv.newDomainConfig()
+	config.ServerURL = redirector.URL
+	p := Provider{Configs: map[string]DomainConfig{"example.com": config}}
+
+	_, err := p.AppendRecords(context.TODO(), "example.com", []libdns.Record{makeRecord("value")})
+	if err == nil {
+		t.Fatal("Expected redirect to result in an error")
+	}
+	if !strings.Contains(err.Error(), srv.URL+"/update") {
+		t.Fatalf("Expected error to mention redirect location, got: %v", err)
+	}
+	if len(srv.requests) != 0 {
+		t.Fatal("Redirect must not be followed")
+	}
+}
+
+func TestAuditHook(t *testing.T) {
+	srv := newMockServer(t)
+	config := srv.newDomainConfig()
+	var events []AuditEvent
+	p := Provider{
+		Configs:   map[string]DomainConfig{"example.com": config},
+		AuditHook: func(e AuditEvent) { events = append(events, e) },
+	}
+
+	_, err := p.AppendRecords(context.TODO(), "example.com", []libdns.Record{makeRecord("secret-value")})
+	if err != nil {
+		t.Fatal("Failed to append records: ", err)
+	}
+	if len(events) != 1 {
+		t.Fatalf("Expected 1 audit event, got %d", len(events))
+	}
+	e := events[0]
+	if e.Operation != "append" || e.Domain != "example.com" || e.ServerURL != srv.URL || e.Err != nil || e.Time.IsZero() {
+		t.Fatalf("Unexpected audit event %+v", e)
+	}
+	if dump := fmt.Sprintf("%+v", e); strings.Contains(dump, config.Password) || strings.Contains(dump, "secret-value") {
+		t.Fatalf("Audit event contains secrets: %s", dump)
+	}
+}
+
+func TestUpdateMethod(t *testing.T) {
+	srv := newMockServer(t)
+	p := Provider{
+		Configs:      map[string]DomainConfig{"example.com": srv.newDomainConfig()},
+		UpdateMethod: "PUT",
+	}
+
+	_, err := p.AppendRecords(context.TODO(), "example.com", []libdns.Record{makeRecord("value")})
+	if err != nil {
+		t.Fatal("Failed to append records: ", err)
+	}
+	if method := srv.requests[0].Method; method != "PUT" {
+		t.Fatalf("Unexpected method %s", method)
+	}
+
+	p.UpdateMethod = "DELETE"
+	_, err = p.AppendRecords(context.TODO(), "example.com", []libdns.Record{makeRecord("value")})
+	if err == nil {
+		t.Fatal("Expected unsupported method to be rejected")
+	}
+}
+
+func TestUnmarshalLegacyDomainConfigs(t *testing.T) {
+	expected := DomainConfig{
+		Username:   "c36f50e8-4632-44f0-83fe-e070fef28a10",
+		Password:   "htB9mR9DYgcu9bX_afHF62erXaH2TS7bg9KW3F7Z",
+		Subdomain:  "1dc9d4fd-9bcd-4ae1-a1e0-f15f1d237b71",
+		FullDomain: "1dc9d4fd-9bcd-4ae1-a1e0-f15f1d237b71.auth.acme-dns.io",
+		ServerURL:  "https://auth.acme-dns.io",
+	}
+	for _, fixture := range []string{
+		"testdata/storage_current.json",
+		"testdata/storage_full_domain.json",
+		"testdata/storage_serverurl.json",
+	} {
+		data, err := ioutil.ReadFile(fixture)
+		if err != nil {
+			t.Fatal("Failed to read fixture: ", err)
+		}
+		var configs map[string]DomainConfig
+		err = json.Unmarshal(data, &configs)
+		if err != nil {
+			t.Fatalf("Failed to unmarshal %s: %v", fixture, err)
+		}
+		if !reflect.DeepEqual(configs["example.com"], expected) {
+			t.Fatalf("Unexpected config loaded from %s: %+v", fixture, configs["example.com"])
+		}
+	}
+}
+
+func TestConfigKeyMode(t *testing.T) {
+	tests := []struct {
+		mode string
+		key  string
+	}{
+		{mode: "", key: "example.com"},
+		{mode: "stripped", key: "example.com"},
+		{mode: "raw", key: "_acme-challenge.example.com"},
+	}
+	for _, test := range tests {
+		p := Provider{
+			Configs:       map[string]DomainConfig{test.key: {Username: "user"}},
+			ConfigKeyMode: test.mode,
+		}
+		acc, err := p.selectAccount("example.com.", "_acme-challenge")
+		if err != nil {
+			t.Fatalf("Mode %q: failed to select account: %v", test.mode, err)
+		}
+		if acc.Username != "user" {
+			t.Fatalf("Mode %q: unexpected account %+v", test.mode, acc)
+		}
+	}
+
+	p := Provider{
+		Configs:       map[string]DomainConfig{"example.com": {Username: "user"}},
+		ConfigKeyMode: "raw",
+	}
+	_, err := p.selectAccount("example.com.", "_acme-challenge")
+	if err == nil {
+		t.Fatal("Expected stripped key not to match in raw mode")
+	}
+}
+
+func TestAppendRecordsPreservesOrder(t *testing.T) {
+	srv := newMockServer(t)
+	p := Provider{Configs: map[string]DomainConfig{"example.com": srv.newDomainConfig()}}
+
+	_, err := p.AppendRecords(context.TODO(), "example.com", []libdns.Record{makeRecord("stale")})
+	if err != nil {
+		t.Fatal("Failed to append records: ", err)
+	}
+	_, err = p.AppendRecords(context.TODO(), "example.com", []libdns.Record{
+		makeRecord("wildcard"),
+		makeRecord("base"),
+	})
+	if err != nil {
+		t.Fatal("Failed to append records: ", err)
+	}
+	records := srv.records(p.Configs["example.com"])
+	if !reflect.DeepEqual(records, []string{"wildcard", "base"}) {
+		t.Fatalf("Unexpected TXT records %v", records)
+	}
+}
+
+func TestAppendRecordsDefaultTimeout(t *testing.T) {
+	done := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-done
+	}))
+	defer slow.Close()
+	defer close(done)
+	p := Provider{
+		Username:       "user",
+		Password:       "password",
+		Subdomain:      "subdomain",
+		ServerURL:      slow.URL,
+		DefaultTimeout: 50 * time.Millisecond,
+	}
+
+	start := time.Now()
+	_, err := p.AppendRecords(context.Background(), "example.com", []libdns.Record{makeRecord("value")})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Expected default deadline to fire, got: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Fatalf("Default deadline fired too late, after %v", elapsed)
+	}
+}
+
+// countingCodec wraps the JSON codec and counts its uses.
+type countingCodec struct {
+	marshals, unmarshals int
+}
+
+func (c *countingCodec) Marshal(v interface{}) ([]byte, error) {
+	c.marshals++
+	return json.Marshal(v)
+}
+
+func (c *countingCodec) Unmarshal(data []byte, v interface{}) error {
+	c.unmarshals++
+	return json.Unmarshal(data, v)
+}
+
+func TestCustomCodec(t *testing.T) {
+	srv := newMockServer(t)
+	codec := &countingCodec{}
+	p := Provider{
+		Configs: map[string]DomainConfig{"example.com": srv.newDomainConfig()},
+		Codec:   codec,
+	}
+
+	_, err := p.AppendRecords(context.TODO(), "example.com", []libdns.Record{makeRecord("value")})
+	if err != nil {
+		t.Fatal("Failed to append records: ", err)
+	}
+	if codec.marshals != 1 || codec.unmarshals != 1 {
+		t.Fatalf("Expected codec to marshal and unmarshal 1 body, got %d and %d", codec.marshals, codec.unmarshals)
+	}
+}
+
+func TestUpdateResponse(t *testing.T) {
+	tests := []struct {
+		body     string
+		expected updateResponse
+		fails    bool
+	}{
+		{body: ""},
+		{body: `{"txt": "value"}`, expected: updateResponse{Txt: "value"}},
+		{
+			body: `{"txt": "value", "subdomain": "subdomain", "fulldomain": "subdomain.auth.example.org"}`,
+			expected: updateResponse{
+				Txt:        "value",
+				Subdomain:  "subdomain",
+				FullDomain: "subdomain.auth.example.org",
+			},
+		},
+		{body: "<html>", fails: true},
+	}
+	for _, test := range tests {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(test.body))
+		}))
+		p := Provider{}
+		updated, err := p.updateTxtValue(context.TODO(), account{Subdomain: "subdomain", ServerURL: srv.URL}, "value")
+		srv.Close()
+		if test.fails {
+			if err == nil {
+				t.Fatalf("Expected response %q to be rejected", test.body)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("Update with response %q failed: %v", test.body, err)
+		}
+		if *updated != test.expected {
+			t.Fatalf("Unexpected update response %+v for body %q", *updated, test.body)
+		}
+	}
+}
+
+func TestGetRecordsMode(t *testing.T) {
+	p := Provider{
+		Configs:  map[string]DomainConfig{"example.com": {FullDomain: "a.auth.example.org"}},
+		Resolver: &fakeResolver{txt: map[string][]string{"a.auth.example.org": {"value"}}},
+	}
+
+	for _, mode := range []string{"", "error", "unknown"} {
+		p.GetRecordsMode = mode
+		_, err := p.GetRecords(context.TODO(), "example.com.")
+		if err == nil {
+			t.Fatalf("Mode %q: expected an error", mode)
+		}
+	}
+
+	p.GetRecordsMode = "empty"
+	records, err := p.GetRecords(context.TODO(), "example.com.")
+	if err != nil || records != nil {
+		t.Fatalf("Mode \"empty\": expected no records and no error, got %v, %v", records, err)
+	}
+
+	p.GetRecordsMode = "resolve"
+	records, err = p.GetRecords(context.TODO(), "example.com.")
+	if err != nil {
+		t.Fatal("Mode \"resolve\": failed to get records: ", err)
+	}
+	expected := []libdns.Record{{ID: "a.auth.example.org", Type: "TXT", Name: "_acme-challenge", Value: "value"}}
+	if !reflect.DeepEqual(records, expected) {
+		t.Fatalf("Mode \"resolve\": unexpected records %v", records)
+	}
+}
+
+func TestParseRegistration(t *testing.T) {
+	f, err := os.Open("testdata/registration.json")
+	if err != nil {
+		t.Fatal("Failed to open fixture: ", err)
+	}
+	defer f.Close()
+
+	config, err := ParseRegistration(f)
+	if err != nil {
+		t.Fatal("Failed to parse registration: ", err)
+	}
+	expected := DomainConfig{
+		Username:   "c36f50e8-4632-44f0-83fe-e070fef28a10",
+		Password:   "htB9mR9DYgcu9bX_afHF62erXaH2TS7bg9KW3F7Z",
+		Subdomain:  "8e5700ea-a4bf-41c7-8a77-e990661dcc6a",
+		FullDomain: "8e5700ea-a4bf-41c7-8a77-e990661dcc6a.auth.acme-dns.io",
+		AllowFrom:  []string{"192.168.100.1/24", "1.2.3.4/32"},
+	}
+	if !reflect.DeepEqual(config, expected) {
+		t.Fatalf("Unexpected config %+v", config)
+	}
+
+	_, err = ParseRegistration(strings.NewReader(`{"username": "user"}`))
+	if err == nil {
+		t.Fatal("Expected incomplete registration to be rejected")
+	}
+}
+
+func TestSelectAccountWithNestedConfigs(t *testing.T) {
+	p := Provider{
+		NestedConfigs: map[string]map[string]DomainConfig{
+			"example.com": {
+				"_acme-challenge.sub": {Username: "sub"},
+				"":                    {Username: "default"},
+			},
+			"other.com": {
+				"_acme-challenge.sub": {Username: "other"},
+			},
+		},
+		Configs: map[string]DomainConfig{
+			"other.com": {Username: "flat"},
+		},
+	}
+	tests := []struct {
+		zone, name string
+		username   string
+	}{
+		{zone: "example.com.", name: "_acme-challenge.sub", username: "sub"},
+		{zone: "example.com.", name: "_acme-challenge", username: "default"},
+		{zone: "example.com.", name: "_acme-challenge.sub.example.com.", username: "sub"},
+		{zone: "example.com.", name: "_ACME-Challenge.Sub", username: "sub"},
+		{zone: "Example.COM.", name: "_acme-challenge.SUB.example.com.", username: "sub"},
+		{zone: "example.com.", name: "_acme-challenge.example.com.", username: "default"},
+		{zone: "other.com.", name: "_acme-challenge.sub", username: "other"},
+		{zone: "other.com.", name: "_acme-challenge", username: "flat"},
+	}
+	for _, test := range tests {
+		acc, err := p.selectAccount(test.zone, test.name)
+		if err != nil {
+			t.Fatalf("Failed to select account for %s in %s: %v", test.name, test.zone, err)
+		}
+		if acc.Username != test.username {
+			t.Fatalf("Selected account %s for %s in %s, expected %s", acc.Username, test.name, test.zone, test.username)
+		}
+	}
+
+	_, err := p.selectAccount("missing.com.", "_acme-challenge")
+	if err == nil {
+		t.Fatal("Expected an error for unknown zone")
+	}
+}
+
+func TestTestCredentials(t *testing.T) {
+	srv := newMockServer(t)
+	config := srv.newDomainConfig()
+	var events []AuditEvent
+	p := Provider{AuditHook: func(e AuditEvent) { events = append(events, e) }}
+
+	err := p.TestCredentials(context.TODO(), config)
+	if err != nil {
+		t.Fatal("Valid credentials were rejected: ", err)
+	}
+	if records := srv.records(config); len(records) != 0 {
+		t.Fatalf("Published values changed to %v", records)
+	}
+
+	config.Password = "wrong"
+	err = p.TestCredentials(context.TODO(), config)
+	if !errors.Is(err, ErrUnauthorized) {
+		t.Fatalf("Expected ErrUnauthorized, got: %v", err)
+	}
+	if len(events) != 2 || events[0].Operation != "test" || events[0].Err != nil || !errors.Is(events[1].Err, ErrUnauthorized) {
+		t.Fatalf("Unexpected audit events %+v", events)
+	}
+	if events[0].Domain != config.FullDomain || events[0].ServerURL != srv.URL {
+		t.Fatalf("Unexpected audit event %+v", events[0])
+	}
+}
+
+func TestResponseHook(t *testing.T) {
+	srv := newMockServer(t)
+	var status int
+	var contentType, body string
+	p := Provider{
+		Configs: map[string]DomainConfig{"example.com": srv.newDomainConfig()},
+		ResponseHook: func(resp *http.Response) {
+			status = resp.StatusCode
+			contentType = resp.Header.Get("Content-Type")
+			b, _ := ioutil.ReadAll(resp.Body)
+			body = string(b)
+		},
+	}
+
+	_, err := p.AppendRecords(context.TODO(), "example.com", []libdns.Record{makeRecord("value")})
+	if err != nil {
+		t.Fatal("Failed to append records: ", err)
+	}
+	if status != 200 || contentType == "" || !strings.Contains(body, `"value"`) {
+		t.Fatalf("Unexpected response passed to hook: %d %q %q", status, contentType, body)
+	}
+}
+
+func TestAppendRecordsTrimsWhitespace(t *testing.T) {
+	srv := newMockServer(t)
+	challenge := "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQ"
+	p := Provider{
+		Configs:             map[string]DomainConfig{"example.com": srv.newDomainConfig()},
+		StrictTXTValidation: true,
+	}
+
+	appended, err := p.AppendRecords(context.TODO(), "example.com", []libdns.Record{makeRecord(" " + challenge + "\n")})
+	if err != nil {
+		t.Fatal("Failed to append records: ", err)
+	}
+	if appended[0].Value != challenge {
+		t.Fatalf("Unexpected appended value %q", appended[0].Value)
+	}
+	records := srv.records(p.Configs["example.com"])
+	if len(records) != 1 || records[0] != challenge {
+		t.Fatalf("Unexpected TXT records %q", records)
+	}
+}
+
+func TestExpectedStatus(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+	acc := account{ServerURL: srv.URL}
+
+	p := Provider{}
+	_, err := p.updateTxtValue(context.TODO(), acc, "value")
+	if err == nil {
+		t.Fatal("Expected 204 to be rejected by default")
+	}
+
+	p.ExpectedStatus = []int{200, 204}
+	_, err = p.updateTxtValue(context.TODO(), acc, "value")
+	if err != nil {
+		t.Fatal("Expected 204 to be accepted: ", err)
+	}
+}
+
+func TestToConfigs(t *testing.T) {
+	p := Provider{
+		Username:  "user",
+		Password:  "password",
+		Subdomain: "subdomain",
+		ServerURL: "https://auth.acme-dns.io",
+	}
+	zones := []string{"example.com.", "sub.example.com."}
+	before := map[string]account{}
+	for _, zone := range zones {
+		acc, err := p.selectAccount(zone, "_acme-challenge")
+		if err != nil {
+			t.Fatal("Failed to select account: ", err)
+		}
+		before[zone] = *acc
+	}
+
+	p.Configs = map[string]DomainConfig{"taken.com": {}}
+	for _, domains := range [][]string{
+		{"example.com", "taken.com"},
+		{"example.com", "Example.com."},
+		{"example.com", ".."},
+	} {
+		if err := p.ToConfigs(domains); err == nil {
+			t.Fatalf("Expected migration of %v to fail", domains)
+		}
+		if len(p.Configs) != 1 || p.Username != "user" {
+			t.Fatalf("Failed migration of %v changed Provider: %+v", domains, &p)
+		}
+	}
+	p.Configs = nil
+
+	err := p.ToConfigs([]string{"example.com", "Sub.Example.com."})
+	if err != nil {
+		t.Fatal("Failed to migrate to configs: ", err)
+	}
+	if p.Username != "" || p.Password != "" || p.Subdomain != "" || p.ServerURL != "" {
+		t.Fatalf("Single-account fields were not cleared: %+v", &p)
+	}
+	for _, zone := range zones {
+		acc, err := p.selectAccount(zone, "_acme-challenge")
+		if err != nil {
+			t.Fatal("Failed to select account after migration: ", err)
+		}
+		if !reflect.DeepEqual(*acc, before[zone]) {
+			t.Fatalf("Account for %s changed from %+v to %+v", zone, before[zone], *acc)
+		}
+	}
+
+	err = p.ToConfigs([]string{"example.com"})
+	if err == nil {
+		t.Fatal("Expected migration without single-account fields to fail")
+	}
+}
+
+func TestContentType(t *testing.T) {
+	srv := newMockServer(t)
+	p := Provider{Configs: map[string]DomainConfig{"example.com": srv.newDomainConfig()}}
+
+	_, err := p.AppendRecords(context.TODO(), "example.com", []libdns.Record{makeRecord("value")})
+	if err != nil {
+		t.Fatal("Failed to append records: ", err)
+	}
+	p.ContentType = "application/json; charset=utf-8"
+	_, err = p.AppendRecords(context.TODO(), "example.com", []libdns.Record{makeRecord("value")})
+	if err != nil {
+		t.Fatal("Failed to append records: ", err)
+	}
+	if contentType := srv.requests[0].Header.Get("Content-Type"); contentType != "application/json" {
+		t.Fatalf("Unexpected default Content-Type %q", contentType)
+	}
+	if contentType := srv.requests[1].Header.Get("Content-Type"); contentType != p.ContentType {
+		t.Fatalf("Unexpected Content-Type %q", contentType)
+	}
+}
+
+func TestSelectAccountWithEmptyConfigs(t *testing.T) {
+	p := Provider{
+		Configs:   map[string]DomainConfig{},
+		Username:  "user",
+		Password:  "password",
+		Subdomain: "subdomain",
+		ServerURL: "https://auth.acme-dns.io",
+	}
+	acc, err := p.selectAccount("example.com.", "_acme-challenge")
+	if err != nil {
+		t.Fatal("Failed to select single account with empty Configs: ", err)
+	}
+	if acc.Username != "user" {
+		t.Fatalf("Unexpected account %+v", acc)
+	}
+	err = p.Validate()
+	if err != nil {
+		t.Fatal("Validation failed: ", err)
+	}
+}
+
+func TestUpdateTimeout(t *testing.T) {
+	done := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-done
+	}))
+	defer slow.Close()
+	defer close(done)
+	p := Provider{UpdateTimeout: 50 * time.Millisecond}
+
+	start := time.Now()
+	_, err := p.updateTxtValue(context.Background(), account{ServerURL: slow.URL}, "value")
+	if err == nil {
+		t.Fatal("Expected update to time out")
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Fatalf("Update timed out too late, after %v", elapsed)
+	}
+}
+
+func TestForwardedForHeader(t *testing.T) {
+	srv := newMockServer(t)
+	p := Provider{
+		Configs:           map[string]DomainConfig{"example.com": srv.newDomainConfig()},
+		ForwardedForValue: "198.51.100.7",
+	}
+
+	_, err := p.AppendRecords(context.TODO(), "example.com", []libdns.Record{makeRecord("value")})
+	if err != nil {
+		t.Fatal("Failed to append records: ", err)
+	}
+	p.ForwardedForHeader = "X-Real-Ip"
+	_, err = p.AppendRecords(context.TODO(), "example.com", []libdns.Record{makeRecord("value")})
+	if err != nil {
+		t.Fatal("Failed to append records: ", err)
+	}
+	if value := srv.requests[0].Header.Get("X-Forwarded-For"); value != "198.51.100.7" {
+		t.Fatalf("Unexpected X-Forwarded-For header %q", value)
+	}
+	if value := srv.requests[1].Header.Get("X-Real-Ip"); value != "198.51.100.7" {
+		t.Fatalf("Unexpected X-Real-Ip header %q", value)
+	}
+}
+
+func TestUserAgentSuffix(t *testing.T) {
+	srv := newMockServer(t)
+	p := Provider{
+		Configs:         map[string]DomainConfig{"example.com": srv.newDomainConfig()},
+		UserAgentSuffix: "myapp/1.2",
+	}
+
+	_, err := p.AppendRecords(context.TODO(), "example.com", []libdns.Record{makeRecord("value")})
+	if err != nil {
+		t.Fatal("Failed to append records: ", err)
+	}
+	ua := srv.requests[0].Header.Get("User-Agent")
+	if !strings.Contains(ua, "libdns-acmedns") || !strings.Contains(ua, "myapp/1.2") {
+		t.Fatalf("Unexpected User-Agent %q", ua)
+	}
+}
+
+func TestUpdateSubdomainMismatch(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"txt": "value", "subdomain": "other"}`))
+	}))
+	defer srv.Close()
+	p := Provider{}
+
+	_, err := p.updateTxtValue(context.TODO(), account{Subdomain: "subdomain", ServerURL: srv.URL}, "value")
+	if err == nil || !strings.Contains(err.Error(), "same account") {
+		t.Fatalf("Expected subdomain mismatch error, got: %v", err)
+	}
+}
+
+func TestStripLabels(t *testing.T) {
+	tests := []struct {
+		stripLabels int
+		key         string
+	}{
+		{stripLabels: 0, key: "sub.example.com"},
+		{stripLabels: 1, key: "sub.example.com"},
+		{stripLabels: 2, key: "example.com"},
+	}
+	for _, test := range tests {
+		p := Provider{StripLabels: test.stripLabels}
+		key, err := p.configKey("example.com.", "_acme-challenge.sub")
+		if err != nil {
+			t.Fatalf("StripLabels %d: %v", test.stripLabels, err)
+		}
+		if key != test.key {
+			t.Fatalf("StripLabels %d: got key %s, expected %s", test.stripLabels, key, test.key)
+		}
+	}
+
+	p := Provider{StripLabels: 4}
+	_, err := p.configKey("example.com.", "_acme-challenge.sub")
+	if err == nil {
+		t.Fatal("Expected an error when stripping all labels")
+	}
+}
+
+func TestSuccessFunc(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"status": "failed"}`))
+	}))
+	defer srv.Close()
+	acc := account{ServerURL: srv.URL}
+
+	p := Provider{}
+	_, err := p.updateTxtValue(context.TODO(), acc, "value")
+	if err != nil {
+		t.Fatal("Expected 200 to succeed without SuccessFunc: ", err)
+	}
+
+	p.SuccessFunc = func(resp *http.Response) bool {
+		var body struct {
+			Status string `json:"status"`
+		}
+		return json.NewDecoder(resp.Body).Decode(&body) == nil && body.Status != "failed"
+	}
+	_, err = p.updateTxtValue(context.TODO(), acc, "value")
+	if err == nil {
+		t.Fatal("Expected SuccessFunc to reject the response")
+	}
+}
+
+func TestAppendRecordsTrimsCredentials(t *testing.T) {
+	srv := newMockServer(t)
+	config := srv.newDomainConfig()
+	p := Provider{
+		Username:  " " + config.Username + "\n",
+		Password:  config.Password + " ",
+		Subdomain: "\t" + config.Subdomain,
+		ServerURL: config.ServerURL,
+	}
+
+	_, err := p.AppendRecords(context.TODO(), "example.com", []libdns.Record{makeRecord("value")})
+	if err != nil {
+		t.Fatal("Failed to append records with padded credentials: ", err)
+	}
+
+	var configs map[string]DomainConfig
+	err = json.Unmarshal([]byte(`{"example.com": {"username": " user\n", "password": "password ", "subdomain": " sub"}}`), &configs)
+	if err != nil {
+		t.Fatal("Failed to unmarshal configs: ", err)
+	}
+	if c := configs["example.com"]; c.Username != "user" || c.Password != "password" || c.Subdomain != "sub" {
+		t.Fatalf("Credentials were not trimmed: %+v", c)
+	}
+}
+
+func TestGetRecordsCNAMEMode(t *testing.T) {
+	p := Provider{
+		Configs:        map[string]DomainConfig{"example.com": {FullDomain: "a.auth.example.org"}},
+		GetRecordsMode: "cname",
+	}
+	records, err := p.GetRecords(context.TODO(), "example.com.")
+	if err != nil {
+		t.Fatal("Failed to get records: ", err)
+	}
+	expected := []libdns.Record{{Type: "CNAME", Name: "_acme-challenge", Value: "a.auth.example.org."}}
+	if !reflect.DeepEqual(records, expected) {
+		t.Fatalf("Unexpected records %v", records)
+	}
+}
+
+func TestMaxRecordsPerCall(t *testing.T) {
+	srv := newMockServer(t)
+	config := srv.newDomainConfig()
+	p := Provider{Configs: map[string]DomainConfig{"example.com": config}, MaxRecordsPerCall: 2}
+
+	recs := []libdns.Record{makeRecord("first"), makeRecord("second"), makeRecord("third")}
+	_, err := p.AppendRecords(context.TODO(), "example.com", recs)
+	if err == nil {
+		t.Fatal("Expected an error when appending more records than allowed")
+	}
+	if len(srv.requests) != 0 {
+		t.Fatalf("Expected no requests, got %d", len(srv.requests))
+	}
+
+	if _, err := p.AppendRecords(context.TODO(), "example.com", recs[:2]); err != nil {
+		t.Fatal("Failed to append records within the limit: ", err)
+	}
+}
+
+func TestAppendRecordsReturnsAbsoluteNames(t *testing.T) {
+	srv := newMockServer(t)
+	config := srv.newDomainConfig()
+	p := Provider{Configs: map[string]DomainConfig{
+		"example.com":     config,
+		"sub.example.com": config,
+	}}
+
+	tests := []struct {
+		zone, name string
+		expected   string
+	}{
+		{zone: "example.com", name: "_acme-challenge", expected: "_acme-challenge.example.com."},
+		{zone: "example.com.", name: "_acme-challenge.Sub", expected: "_acme-challenge.sub.example.com."},
+		{zone: "example.com.", name: "_acme-challenge.sub.example.com.", expected: "_acme-challenge.sub.example.com."},
+	}
+	for _, test := range tests {
+		record := makeRecord("value")
+		record.Name = test.name
+		appended, err := p.AppendRecords(context.TODO(), test.zone, []libdns.Record{record})
+		if err != nil {
+			t.Fatal("Failed to append records: ", err)
+		}
+		if len(appended) != 1 || appended[0].Name != test.expected {
+			t.Fatalf("Record %q in zone %q: expected name %q, got %v", test.name, test.zone, test.expected, appended)
+		}
+	}
+}
+
+func TestAppendRecordsWithUnnormalizableNames(t *testing.T) {
+	srv := newMockServer(t)
+	config := srv.newDomainConfig()
+	p := Provider{
+		Username:  config.Username,
+		Password:  config.Password,
+		Subdomain: config.Subdomain,
+		ServerURL: config.ServerURL,
+	}
+	tests := []struct {
+		name     string
+		expected string
+	}{
+		{name: "a..b", expected: "a..b.example.com."},
+		{name: "_acme-challenge.\xff", expected: "_acme-challenge.\xff.example.com."},
+	}
+	for _, test := range tests {
+		record := makeRecord("value")
+		record.Name = test.name
+		appended, err := p.AppendRecords(context.TODO(), "example.com.", []libdns.Record{record})
+		if err != nil {
+			t.Fatalf("Record %q: failed to append records: %v", test.name, err)
+		}
+		if len(appended) != 1 || appended[0].Name != test.expected {
+			t.Fatalf("Record %q: expected name %q, got %v", test.name, test.expected, appended)
+		}
+	}
+
+	p = Provider{Configs: map[string]DomainConfig{"example.com": config}}
+	record := makeRecord("value")
+	record.Name = "a..b"
+	_, err := p.AppendRecords(context.TODO(), "example.com.", []libdns.Record{record})
+	if err == nil {
+		t.Fatal("Expected an error for an invalid name with Configs")
+	}
+}
+
+func TestDebugHook(t *testing.T) {
+	srv := newFlakyServer(t, 1, http.StatusBadRequest)
+	type call struct {
+		domain, serverURL string
+		status            int
+		failed            bool
+	}
+	var calls []call
+	p := Provider{
+		Configs: map[string]DomainConfig{"example.com": {Username: "user", Password: "password", Subdomain: "subdomain", ServerURL: srv.URL}},
+		DebugHook: func(domain, serverURL string, status int, err error) {
+			calls = append(calls, call{domain, serverURL, status, err != nil})
+		},
+	}
+
+	_, err := p.AppendRecords(context.TODO(), "example.com", []libdns.Record{makeRecord("value")})
+	if err == nil {
+		t.Fatal("Expected the first update to fail")
+	}
+	_, err = p.AppendRecords(context.TODO(), "example.com", []libdns.Record{makeRecord("value")})
+	if err != nil {
+		t.Fatal("Failed to append records: ", err)
+	}
+	expected := []call{
+		{"example.com", srv.URL, http.StatusBadRequest, true},
+		{"example.com", srv.URL, http.StatusOK, false},
+	}
+	if !reflect.DeepEqual(calls, expected) {
+		t.Fatalf("Unexpected hook calls %+v", calls)
+	}
+}
+
+func TestAccountForFQDN(t *testing.T) {
+	p := Provider{Configs: map[string]DomainConfig{
+		"example.com":       {Username: "apex", ServerURL: "https://auth.example.org", Subdomain: "apex"},
+		"a.b.example.com":   {Username: "nested", FullDomain: "nested.auth.example.org"},
+		"xn--mnchen-3ya.de": {Username: "idn"},
+	}}
+	tests := []struct {
+		fqdn     string
+		username string
+	}{
+		{fqdn: "_acme-challenge.example.com.", username: "apex"},
+		{fqdn: "_acme-challenge.example.com", username: "apex"},
+		{fqdn: "_acme-challenge.a.b.example.com.", username: "nested"},
+		{fqdn: "_ACME-CHALLENGE.A.B.Example.com.", username: "nested"},
+		{fqdn: "_acme-challenge.münchen.de.", username: "idn"},
+	}
+	for _, test := range tests {
+		config, err := p.AccountForFQDN(test.fqdn)
+		if err != nil {
+			t.Fatalf("%s: failed to find account: %v", test.fqdn, err)
+		}
+		if config.Username != test.username {
+			t.Fatalf("%s: expected account %s, got %+v", test.fqdn, test.username, config)
+		}
+	}
+
+	config, err := p.AccountForFQDN("_acme-challenge.example.com.")
+	if err != nil || config.FullDomain != "apex.auth.example.org" {
+		t.Fatalf("Expected derived FullDomain, got %+v, %v", config, err)
+	}
+	_, err = p.AccountForFQDN("_acme-challenge.b.example.com.")
+	if ErrorCode(err) != CodeConfigNotFound {
+		t.Fatalf("Expected config not found, got %v", err)
+	}
+}
+
+func TestAccountForFQDNWithNestedConfigs(t *testing.T) {
+	p := Provider{NestedConfigs: map[string]map[string]DomainConfig{
+		"example.com": {
+			"_acme-challenge.sub": {Username: "sub", FullDomain: "sub.auth.example.org"},
+			"":                    {Username: "default", FullDomain: "default.auth.example.org"},
+		},
+		"Inner.Example.com": {
+			"_acme-challenge": {Username: "inner", FullDomain: "inner.auth.example.org"},
+		},
+	}}
+	tests := []struct {
+		fqdn     string
+		username string
+	}{
+		{fqdn: "_acme-challenge.sub.example.com.", username: "sub"},
+		{fqdn: "_acme-challenge.sub.example.com", username: "sub"},
+		{fqdn: "_acme-challenge.other.example.com.", username: "default"},
+		{fqdn: "_acme-challenge.inner.example.com.", username: "inner"},
+	}
+	for _, test := range tests {
+		config, err := p.AccountForFQDN(test.fqdn)
+		if err != nil {
+			t.Fatalf("%s: failed to find account: %v", test.fqdn, err)
+		}
+		if config.Username != test.username {
+			t.Fatalf("%s: expected account %s, got %+v", test.fqdn, test.username, config)
+		}
+	}
+
+	_, err := p.AccountForFQDN("_acme-challenge.example.org.")
+	if err == nil {
+		t.Fatal("Expected an error for a name outside of NestedConfigs zones")
+	}
+}
+
+func TestAllowEmptyZone(t *testing.T) {
+	srv := newMockServer(t)
+	config := srv.newDomainConfig()
+	p := Provider{Configs: map[string]DomainConfig{"sub.example.com": config}}
+	record := makeRecord("value")
+	record.Name = "_acme-challenge.sub.example.com"
+
+	for _, zone := range []string{"", "."} {
+		_, err := p.AppendRecords(context.TODO(), zone, []libdns.Record{record})
+		if err == nil || !strings.Contains(err.Error(), "AllowEmptyZone") {
+			t.Fatalf("Zone %q: expected an empty zone error, got %v", zone, err)
+		}
+	}
+	if len(srv.requests) != 0 {
+		t.Fatalf("Expected no requests, got %d", len(srv.requests))
+	}
+
+	p.AllowEmptyZone = true
+	for _, name := range []string{"_acme-challenge.sub.example.com", "_acme-challenge.sub.example.com."} {
+		record.Name = name
+		appended, err := p.AppendRecords(context.TODO(), "", []libdns.Record{record})
+		if err != nil {
+			t.Fatalf("Name %q: failed to append record with empty zone: %v", name, err)
+		}
+		if appended[0].Name != "_acme-challenge.sub.example.com." {
+			t.Fatalf("Name %q: unexpected appended name %q", name, appended[0].Name)
+		}
+	}
+	if records := srv.records(config); len(records) != 2 {
+		t.Fatalf("Unexpected TXT records %v", records)
+	}
+}
+
+func TestSingleAccountFastPath(t *testing.T) {
+	p := Provider{Username: " user", Password: "password", Subdomain: "subdomain", ServerURL: "https://auth.example.org"}
+	for _, name := range []string{"_acme-challenge", "_acme-challenge.sub", "other"} {
+		acc, err := p.selectAccount("example.com.", name)
+		if err != nil {
+			t.Fatal("Failed to select account: ", err)
+		}
+		domain, err := p.configKey("example.com.", name)
+		if err != nil {
+			t.Fatal("Failed to compute config key: ", err)
+		}
+		expected := configAccount(domain, DomainConfig{Username: p.Username, Password: p.Password, Subdomain: p.Subdomain, ServerURL: p.ServerURL})
+		if !reflect.DeepEqual(acc, expected) {
+			t.Fatalf("Name %q: expected account %+v, got %+v", name, expected, acc)
+		}
+	}
+
+	p.Subdomain = "changed"
+	acc, err := p.selectAccount("example.com.", "_acme-challenge")
+	if err != nil || acc.Subdomain != "changed" || acc.FullDomain != "changed.auth.example.org" {
+		t.Fatalf("Changed fields were not used, got %+v, %v", acc, err)
+	}
+	for _, password := range []string{"", " \n"} {
+		p.Password = password
+		if _, err := p.selectAccount("example.com.", "_acme-challenge"); ErrorCode(err) != CodeMissingCredentials {
+			t.Fatalf("Password %q: expected missing credentials, got %v", password, err)
+		}
+		if err := p.Validate(); ErrorCode(err) != CodeMissingCredentials {
+			t.Fatalf("Password %q: expected Validate to report missing credentials, got %v", password, err)
+		}
+	}
+}
+
+func BenchmarkSelectSingleAccount(b *testing.B) {
+	p := Provider{Username: "user", Password: "password", Subdomain: "subdomain", ServerURL: "https://auth.example.org"}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		_, err := p.selectAccount("example.com.", "_acme-challenge")
+		if err != nil {
+			b.Fatal("Failed to select account: ", err)
+		}
+	}
+}
+
+func TestUpdateBodyFunc(t *testing.T) {
+	var body []byte
+	var header http.Header
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ = ioutil.ReadAll(r.Body)
+		header = r.Header.Clone()
+	}))
+	defer srv.Close()
+	p := Provider{
+		Username:  "user",
+		Password:  "password",
+		Subdomain: "subdomain",
+		ServerURL: srv.URL,
+		UpdateBodyFunc: func(config DomainConfig, value string) ([]byte, error) {
+			return []byte(`{"record":"` + config.Subdomain + `","values":["` + value + `"]}`), nil
+		},
+	}
+
+	_, err := p.AppendRecords(context.TODO(), "example.com", []libdns.Record{makeRecord("value")})
+	if err != nil {
+		t.Fatal("Failed to append records: ", err)
+	}
+	if string(body) != `{"record":"subdomain","values":["value"]}` {
+		t.Fatalf("Unexpected request body %s", body)
+	}
+	if header.Get("X-Api-User") != "user" || header.Get("X-Api-Key") != "password" {
+		t.Fatalf("Credential headers were not set: %v", header)
+	}
+
+	p.UpdateBodyFunc = func(config DomainConfig, value string) ([]byte, error) {
+		return nil, errors.New("unsupported value")
+	}
+	_, err = p.AppendRecords(context.TODO(), "example.com", []libdns.Record{makeRecord("value")})
+	if err == nil || !strings.Contains(err.Error(), "unsupported value") {
+		t.Fatalf("Expected the body function error, got %v", err)
+	}
+}
+
+func TestRelativizeNames(t *testing.T) {
+	srv := newMockServer(t)
+	config := srv.newDomainConfig()
+	p := Provider{
+		Configs:         map[string]DomainConfig{"sub.example.com": config, "example.com": config},
+		RelativizeNames: true,
+	}
+	tests := []struct {
+		name     string
+		expected string
+	}{
+		{name: "_acme-challenge.sub", expected: "_acme-challenge.sub.example.com."},
+		{name: "_acme-challenge.sub.example.com", expected: "_acme-challenge.sub.example.com."},
+		{name: "_acme-challenge.sub.Example.COM", expected: "_acme-challenge.sub.example.com."},
+		{name: "_acme-challenge.sub.example.com.", expected: "_acme-challenge.sub.example.com."},
+		{name: "_acme-challenge.example.com", expected: "_acme-challenge.example.com."},
+		{name: "example.com", expected: "example.com."},
+	}
+	for _, test := range tests {
+		record := makeRecord("value")
+		record.Name = test.name
+		appended, err := p.AppendRecords(context.TODO(), "example.com.", []libdns.Record{record})
+		if err != nil {
+			t.Fatalf("Name %q: failed to append record: %v", test.name, err)
+		}
+		if appended[0].Name != test.expected {
+			t.Fatalf("Name %q: expected %q, got %q", test.name, test.expected, appended[0].Name)
+		}
+	}
+
+	p.RelativizeNames = false
+	record := makeRecord("value")
+	record.Name = "_acme-challenge.sub.example.com"
+	_, err := p.AppendRecords(context.TODO(), "example.com.", []libdns.Record{record})
+	if ErrorCode(err) != CodeConfigNotFound {
+		t.Fatalf("Expected config not found without RelativizeNames, got %v", err)
+	}
+}
+
+func TestProviderCopy(t *testing.T) {
+	srv := newMockServer(t)
+	config := srv.newDomainConfig()
+	p := Provider{Configs: map[string]DomainConfig{"example.com": config}}
+	_, err := p.AppendRecords(context.TODO(), "example.com.", []libdns.Record{makeRecord("value1")})
+	if err != nil {
+		t.Fatal("Failed to append record: ", err)
+	}
+
+	copied := p
+	copied.UserAgentSuffix = "copy/1.0"
+	_, err = copied.AppendRecords(context.TODO(), "example.com.", []libdns.Record{makeRecord("value2")})
+	if err != nil {
+		t.Fatal("Failed to append record with copied Provider: ", err)
+	}
+	acc, err := p.selectAccount("example.com.", "_acme-challenge")
+	if err != nil {
+		t.Fatal("Failed to select account: ", err)
+	}
+	if values := p.st().history.get(*acc); !reflect.DeepEqual(values, []string{"value1", "value2"}) {
+		t.Fatalf("Expected history shared with the copy, got %v", values)
+	}
+}
+
+func TestReset(t *testing.T) {
+	srv := newMockServer(t)
+	config := srv.newDomainConfig()
+	p := Provider{
+		Configs:            map[string]DomainConfig{"example.com": config},
+		ConditionalUpdates: true,
+		IdleConnTimeout:    time.Minute,
+	}
+	_, err := p.AppendRecords(context.TODO(), "example.com.", []libdns.Record{makeRecord("value")})
+	if err != nil {
+		t.Fatal("Failed to append record: ", err)
+	}
+	acc, err := p.selectAccount("example.com.", "_acme-challenge")
+	if err != nil {
+		t.Fatal("Failed to select account: ", err)
+	}
+	p.st().etags.set(*acc, `"1"`)
+	transport := p.st().transports.get(&p)
+
+	p.Reset()
+	if values := p.st().history.get(*acc); len(values) != 0 {
+		t.Fatalf("Expected history to be cleared, got %v", values)
+	}
+	if etag := p.st().etags.get(*acc); etag != "" {
+		t.Fatalf("Expected ETag to be cleared, got %q", etag)
+	}
+	if p.st().transports.get(&p) == transport {
+		t.Fatal("Expected transport to be rebuilt after Reset")
+	}
+}
+
+func TestSelectAccountWithUnnormalizedConfigKeys(t *testing.T) {
+	p := Provider{
+		Configs: map[string]DomainConfig{
+			"Example.com": {Username: "mixed"},
+			"bücher.de":   {Username: "unicode"},
+			"Sub.Other.":  {Username: "dot"},
+		},
+	}
+	tests := []struct {
+		zone, name string
+		username   string
+	}{
+		{zone: "Example.com", name: "_acme-challenge", username: "mixed"},
+		{zone: "example.com.", name: "_acme-challenge", username: "mixed"},
+		{zone: "bücher.de.", name: "_acme-challenge", username: "unicode"},
+		{zone: "xn--bcher-kva.de.", name: "_acme-challenge", username: "unicode"},
+		{zone: "other.", name: "_acme-challenge.sub", username: "dot"},
+	}
+	for _, test := range tests {
+		acc, err := p.selectAccount(test.zone, test.name)
+		if err != nil {
+			t.Fatalf("Failed to select account for %s in %s: %v", test.name, test.zone, err)
+		}
+		if acc.Username != test.username {
+			t.Fatalf("Selected account %s for %s in %s, expected %s", acc.Username, test.name, test.zone, test.username)
+		}
+	}
+}
@@ -0,0 +1,134 @@
+package acmedns
+
+import (
+	"context"
+	"math/rand"
+	"net/http"
+	"time"
+)
+
+// RetryPolicy decides whether a failed update request is retried.
+//
+// NextDelay is called after the attempt-th attempt (starting from 1)
+// failed with err. resp is the received response, with its body already
+// consumed, or nil if no response was received. It returns how long to
+// wait before the next attempt and whether to retry at all.
+type RetryPolicy interface {
+	NextDelay(attempt int, resp *http.Response, err error) (time.Duration, bool)
+}
+
+// NoRetry never retries failed requests.
+type NoRetry struct{}
+
+func (NoRetry) NextDelay(attempt int, resp *http.Response, err error) (time.Duration, bool) {
+	return 0, false
+}
+
+// FixedRetry retries transient failures up to MaxRetries times,
+// waiting Delay between attempts.
+type FixedRetry struct {
+	Delay      time.Duration
+	MaxRetries int
+}
+
+func (r FixedRetry) NextDelay(attempt int, resp *http.Response, err error) (time.Duration, bool) {
+	if attempt > r.MaxRetries || !isTransient(resp) {
+		return 0, false
+	}
+	return r.Delay, true
+}
+
+// Default parameters of ExponentialRetry backoff.
+const (
+	defaultBackoffBase       = time.Second
+	defaultBackoffMultiplier = 2
+	defaultMaxBackoff        = 30 * time.Second
+)
+
+// ExponentialRetry retries transient failures up to MaxRetries times,
+// with exponentially growing delays. Full jitter is applied: the actual
+// delay is random between zero and the computed one, so that clients
+// failing at the same time do not retry in sync.
+//
+// Failures are not retried if Base, Multiplier or MaxBackoff is
+// negative.
+type ExponentialRetry struct {
+	MaxRetries int
+
+	// Delay computed after the first attempt. Defaults to 1 second.
+	Base time.Duration
+
+	// Factor the computed delay grows by with each attempt.
+	// Defaults to 2.
+	Multiplier float64
+
+	// Upper bound of the computed delay, so that together with
+	// MaxRetries it bounds the total time spent retrying. Defaults to
+	// 30 seconds.
+	MaxBackoff time.Duration
+
+	// Source of jitter. Defaults to the global math/rand source. A
+	// rand.Rand is not safe for concurrent use, so it must not be
+	// shared by policies used concurrently.
+	Rand *rand.Rand
+}
+
+func (r ExponentialRetry) NextDelay(attempt int, resp *http.Response, err error) (time.Duration, bool) {
+	if attempt > r.MaxRetries || !isTransient(resp) {
+		return 0, false
+	}
+	backoff, valid := r.backoff(attempt)
+	if !valid {
+		return 0, false
+	}
+	if r.Rand != nil {
+		return time.Duration(r.Rand.Int63n(int64(backoff) + 1)), true
+	}
+	return time.Duration(rand.Int63n(int64(backoff) + 1)), true
+}
+
+// backoff returns the delay after attempt before jitter is applied,
+// capped at MaxBackoff. It reports false if the policy parameters are
+// invalid.
+func (r ExponentialRetry) backoff(attempt int) (time.Duration, bool) {
+	base, multiplier, maxBackoff := r.Base, r.Multiplier, r.MaxBackoff
+	if base == 0 {
+		base = defaultBackoffBase
+	}
+	if multiplier == 0 {
+		multiplier = defaultBackoffMultiplier
+	}
+	if maxBackoff == 0 {
+		maxBackoff = defaultMaxBackoff
+	}
+	if base < 0 || !(multiplier > 0) || maxBackoff < 0 {
+		return 0, false
+	}
+	delay := float64(base)
+	for i := 1; i < attempt && delay < float64(maxBackoff); i++ {
+		delay *= multiplier
+	}
+	if !(delay < float64(maxBackoff)) {
+		return maxBackoff, true
+	}
+	return time.Duration(delay), true
+}
+
+// isTransient reports whether a failure with response resp (nil if no
+// response was received) may succeed when retried.
+func isTransient(resp *http.Response) bool {
+	if resp == nil {
+		return true
+	}
+	return resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500
+}
+
+func (p *Provider) retryPolicy(ctx context.Context) RetryPolicy {
+	if policy, found := retryPolicyFromContext(ctx); found && policy != nil {
+		return policy
+	}
+	if p.RetryPolicy != nil {
+		return p.RetryPolicy
+	}
+	return NoRetry{}
+}
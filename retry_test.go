@@ -0,0 +1,192 @@
+package acmedns
+
+import (
+	"context"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// flakyServer fails the first failures requests with status.
+type flakyServer struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	failures int
+	requests int
+}
+
+func newFlakyServer(t *testing.T, failures int, status int) *flakyServer {
+	s := &flakyServer{failures: failures}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.requests++
+		if s.requests <= s.failures {
+			w.WriteHeader(status)
+		}
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func TestRetryPolicies(t *testing.T) {
+	tests := []struct {
+		name     string
+		policy   RetryPolicy
+		failures int
+		status   int
+		requests int
+		fails    bool
+	}{
+		{name: "default", policy: nil, failures: 1, status: 503, requests: 1, fails: true},
+		{name: "none", policy: NoRetry{}, failures: 1, status: 503, requests: 1, fails: true},
+		{name: "fixed", policy: FixedRetry{Delay: time.Millisecond, MaxRetries: 3}, failures: 2, status: 503, requests: 3},
+		{name: "fixed exhausted", policy: FixedRetry{Delay: time.Millisecond, MaxRetries: 1}, failures: 2, status: 503, requests: 2, fails: true},
+		{name: "fixed client error", policy: FixedRetry{Delay: time.Millisecond, MaxRetries: 3}, failures: 1, status: 400, requests: 1, fails: true},
+		{name: "exponential", policy: ExponentialRetry{MaxRetries: 1}, failures: 1, status: 429, requests: 2},
+	}
+	for _, test := range tests {
+		srv := newFlakyServer(t, test.failures, test.status)
+		p := Provider{RetryPolicy: test.policy}
+		_, err := p.updateTxtValue(context.TODO(), account{ServerURL: srv.URL}, "value")
+		if (err != nil) != test.fails {
+			t.Fatalf("%s: unexpected update result: %v", test.name, err)
+		}
+		if srv.requests != test.requests {
+			t.Fatalf("%s: expected %d requests, got %d", test.name, test.requests, srv.requests)
+		}
+	}
+}
+
+func TestRetryUpdateTimeoutPerAttempt(t *testing.T) {
+	var mu sync.Mutex
+	requests := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(60 * time.Millisecond)
+		mu.Lock()
+		defer mu.Unlock()
+		requests++
+		if requests < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer srv.Close()
+	p := Provider{
+		UpdateTimeout: 100 * time.Millisecond,
+		RetryPolicy:   FixedRetry{Delay: 20 * time.Millisecond, MaxRetries: 2},
+	}
+	_, err := p.updateTxtValue(context.TODO(), account{ServerURL: srv.URL}, "value")
+	if err != nil {
+		t.Fatal("Expected the third attempt to succeed within its own timeout: ", err)
+	}
+	if requests != 3 {
+		t.Fatalf("Expected 3 requests, got %d", requests)
+	}
+}
+
+func TestExponentialRetryDelays(t *testing.T) {
+	policy := ExponentialRetry{MaxRetries: 4}
+	maxDelay := time.Second
+	for attempt := 1; attempt <= 4; attempt++ {
+		for i := 0; i < 100; i++ {
+			delay, retry := policy.NextDelay(attempt, nil, nil)
+			if !retry {
+				t.Fatalf("Expected attempt %d to be retried", attempt)
+			}
+			if delay < 0 || delay > maxDelay {
+				t.Fatalf("Delay %v after attempt %d is not within [0, %v]", delay, attempt, maxDelay)
+			}
+		}
+		maxDelay *= 2
+	}
+	if _, retry := policy.NextDelay(5, nil, nil); retry {
+		t.Fatal("Expected no retry after MaxRetries")
+	}
+}
+
+func TestExponentialRetryRand(t *testing.T) {
+	policy := ExponentialRetry{MaxRetries: 3, Base: 100 * time.Millisecond, Rand: rand.New(rand.NewSource(1))}
+	same := ExponentialRetry{MaxRetries: 3, Base: 100 * time.Millisecond, Rand: rand.New(rand.NewSource(1))}
+	maxDelay := 100 * time.Millisecond
+	for attempt := 1; attempt <= 3; attempt++ {
+		delay, retry := policy.NextDelay(attempt, nil, nil)
+		if !retry {
+			t.Fatalf("Expected attempt %d to be retried", attempt)
+		}
+		if delay < 0 || delay > maxDelay {
+			t.Fatalf("Delay %v after attempt %d is not within [0, %v]", delay, attempt, maxDelay)
+		}
+		if expected, _ := same.NextDelay(attempt, nil, nil); delay != expected {
+			t.Fatalf("Expected delay %v after attempt %d with the same seed, got %v", expected, attempt, delay)
+		}
+		maxDelay *= 2
+	}
+}
+
+func TestExponentialRetryBackoff(t *testing.T) {
+	tests := []struct {
+		policy   ExponentialRetry
+		expected []time.Duration
+	}{
+		{
+			policy:   ExponentialRetry{},
+			expected: []time.Duration{time.Second, 2 * time.Second, 4 * time.Second},
+		},
+		{
+			policy:   ExponentialRetry{Base: 100 * time.Millisecond, Multiplier: 3},
+			expected: []time.Duration{100 * time.Millisecond, 300 * time.Millisecond, 900 * time.Millisecond},
+		},
+		{
+			policy:   ExponentialRetry{Base: time.Second, Multiplier: 1.5},
+			expected: []time.Duration{time.Second, 1500 * time.Millisecond, 2250 * time.Millisecond},
+		},
+		{
+			policy:   ExponentialRetry{Base: 10 * time.Second, MaxBackoff: 25 * time.Second},
+			expected: []time.Duration{10 * time.Second, 20 * time.Second, 25 * time.Second, 25 * time.Second},
+		},
+	}
+	for _, test := range tests {
+		for i, expected := range test.expected {
+			if delay, _ := test.policy.backoff(i + 1); delay != expected {
+				t.Fatalf("%+v: backoff after attempt %d is %v, expected %v", test.policy, i+1, delay, expected)
+			}
+		}
+	}
+}
+
+func TestExponentialRetryHighAttempts(t *testing.T) {
+	policies := []ExponentialRetry{
+		{MaxRetries: 1000},
+		{MaxRetries: 1000, Multiplier: 10},
+		{MaxRetries: 1000, Base: time.Hour, MaxBackoff: time.Minute},
+	}
+	for _, policy := range policies {
+		maxBackoff := policy.MaxBackoff
+		if maxBackoff == 0 {
+			maxBackoff = defaultMaxBackoff
+		}
+		for _, attempt := range []int{34, 64, 100, 1000} {
+			delay, retry := policy.NextDelay(attempt, nil, nil)
+			if !retry {
+				t.Fatalf("%+v: expected attempt %d to be retried", policy, attempt)
+			}
+			if delay < 0 || delay > maxBackoff {
+				t.Fatalf("%+v: delay %v after attempt %d exceeds %v", policy, delay, attempt, maxBackoff)
+			}
+		}
+	}
+
+	for _, policy := range []ExponentialRetry{
+		{MaxRetries: 3, Base: -time.Second},
+		{MaxRetries: 3, Multiplier: -2},
+		{MaxRetries: 3, MaxBackoff: -time.Second},
+	} {
+		if _, retry := policy.NextDelay(1, nil, nil); retry {
+			t.Fatalf("%+v: expected invalid policy not to retry", policy)
+		}
+	}
+}
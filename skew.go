@@ -0,0 +1,49 @@
+package acmedns
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// Default clock difference reported by Provider.WarnOnClockSkew.
+const defaultClockSkewThreshold = time.Minute
+
+// ClockSkewWarning reports that the clock of an ACME-DNS server, as
+// seen in the Date header of its response, differs from the local one.
+type ClockSkewWarning struct {
+	ServerURL string
+	Skew      time.Duration // positive if the server clock is ahead
+}
+
+func (w *ClockSkewWarning) Error() string {
+	return fmt.Sprintf("Clock of ACME-DNS server %s differs from the local clock by %s", w.ServerURL, w.Skew)
+}
+
+// checkClockSkew reports a *ClockSkewWarning if the Date header of resp
+// differs from now by more than ClockSkewThreshold. Responses without
+// a valid Date header are ignored.
+func (p *Provider) checkClockSkew(serverURL string, resp *http.Response, now time.Time) {
+	date, err := http.ParseTime(resp.Header.Get("Date"))
+	if err != nil {
+		return
+	}
+	threshold := p.ClockSkewThreshold
+	if threshold == 0 {
+		threshold = defaultClockSkewThreshold
+	}
+	skew := date.Sub(now)
+	if skew <= threshold && skew >= -threshold {
+		return
+	}
+	p.warn(&ClockSkewWarning{ServerURL: serverURL, Skew: skew.Round(time.Second)})
+}
+
+func (p *Provider) warn(warning error) {
+	if p.WarningHook != nil {
+		p.WarningHook(warning)
+		return
+	}
+	log.Printf("acmedns: %v", warning)
+}
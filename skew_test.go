@@ -0,0 +1,54 @@
+package acmedns
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func newDateServer(t *testing.T, offset time.Duration) *httptest.Server {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Date", time.Now().Add(offset).UTC().Format(http.TimeFormat))
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestWarnOnClockSkew(t *testing.T) {
+	skewed := newDateServer(t, -10*time.Minute)
+	var warnings []error
+	p := Provider{
+		WarnOnClockSkew: true,
+		WarningHook: func(warning error) {
+			warnings = append(warnings, warning)
+		},
+	}
+
+	_, err := p.updateTxtValue(context.TODO(), account{ServerURL: skewed.URL}, "value")
+	if err != nil {
+		t.Fatal("Update with skewed clock failed: ", err)
+	}
+	var skew *ClockSkewWarning
+	if len(warnings) != 1 || !errors.As(warnings[0], &skew) {
+		t.Fatalf("Expected a clock skew warning, got %v", warnings)
+	}
+	if skew.ServerURL != skewed.URL || skew.Skew > -9*time.Minute || skew.Skew < -11*time.Minute {
+		t.Fatalf("Unexpected warning %+v", skew)
+	}
+
+	warnings = nil
+	accurate := newDateServer(t, 0)
+	_, err = p.updateTxtValue(context.TODO(), account{ServerURL: accurate.URL}, "value")
+	if err != nil || len(warnings) != 0 {
+		t.Fatalf("Expected no warning for an accurate clock, got %v, %v", warnings, err)
+	}
+
+	p.WarnOnClockSkew = false
+	_, err = p.updateTxtValue(context.TODO(), account{ServerURL: skewed.URL}, "value")
+	if err != nil || len(warnings) != 0 {
+		t.Fatalf("Expected no warning when disabled, got %v, %v", warnings, err)
+	}
+}
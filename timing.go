@@ -0,0 +1,76 @@
+package acmedns
+
+import (
+	"context"
+	"crypto/tls"
+	"net/http/httptrace"
+	"sync"
+	"time"
+)
+
+// RequestTiming holds durations of the phases of an update request, as
+// reported to Provider.TimingHook. Phases which did not happen, e.g. DNS
+// and TLS for a reused connection, have zero durations.
+type RequestTiming struct {
+	DNS     time.Duration // host name lookup
+	Connect time.Duration // TCP connection setup
+	TLS     time.Duration // TLS handshake
+	Total   time.Duration // from sending the request to reading the response
+}
+
+// timingTrace collects RequestTiming with httptrace. Hooks may be called
+// from other goroutines than the one sending the request.
+type timingTrace struct {
+	mu           sync.Mutex
+	start        time.Time
+	dnsStart     time.Time
+	connectStart time.Time
+	tlsStart     time.Time
+	timing       RequestTiming
+}
+
+func withTimingTrace(ctx context.Context) (context.Context, *timingTrace) {
+	t := &timingTrace{start: time.Now()}
+	trace := &httptrace.ClientTrace{
+		DNSStart: func(httptrace.DNSStartInfo) {
+			t.mu.Lock()
+			defer t.mu.Unlock()
+			t.dnsStart = time.Now()
+		},
+		DNSDone: func(httptrace.DNSDoneInfo) {
+			t.mu.Lock()
+			defer t.mu.Unlock()
+			t.timing.DNS = time.Since(t.dnsStart)
+		},
+		ConnectStart: func(network, addr string) {
+			t.mu.Lock()
+			defer t.mu.Unlock()
+			t.connectStart = time.Now()
+		},
+		ConnectDone: func(network, addr string, err error) {
+			t.mu.Lock()
+			defer t.mu.Unlock()
+			t.timing.Connect = time.Since(t.connectStart)
+		},
+		TLSHandshakeStart: func() {
+			t.mu.Lock()
+			defer t.mu.Unlock()
+			t.tlsStart = time.Now()
+		},
+		TLSHandshakeDone: func(tls.ConnectionState, error) {
+			t.mu.Lock()
+			defer t.mu.Unlock()
+			t.timing.TLS = time.Since(t.tlsStart)
+		},
+	}
+	return httptrace.WithClientTrace(ctx, trace), t
+}
+
+// done returns the collected timing, with Total measured until now.
+func (t *timingTrace) done() RequestTiming {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	timing := t.timing
+	timing.Total = time.Since(t.start)
+	return timing
+}
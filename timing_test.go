@@ -0,0 +1,53 @@
+package acmedns
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestTraceTiming(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(10 * time.Millisecond)
+	}))
+	defer srv.Close()
+	sum := sha256.Sum256(srv.Certificate().Raw)
+	var timings []RequestTiming
+	p := Provider{
+		PinnedCertSHA256: hex.EncodeToString(sum[:]),
+		TraceTiming:      true,
+		TimingHook: func(domain, serverURL string, timing RequestTiming) {
+			if serverURL != srv.URL {
+				t.Errorf("Unexpected server URL %s", serverURL)
+			}
+			timings = append(timings, timing)
+		},
+	}
+
+	for i := 0; i < 2; i++ {
+		_, err := p.updateTxtValue(context.TODO(), account{ServerURL: srv.URL}, "value")
+		if err != nil {
+			t.Fatal("Update failed: ", err)
+		}
+	}
+	if len(timings) != 2 {
+		t.Fatalf("Expected 2 timings, got %d", len(timings))
+	}
+	if timings[0].Total < 10*time.Millisecond || timings[0].Connect == 0 || timings[0].TLS == 0 {
+		t.Fatalf("Unexpected timing of the first request %+v", timings[0])
+	}
+	if timings[1].Total < 10*time.Millisecond || timings[1].Connect != 0 || timings[1].TLS != 0 {
+		t.Fatalf("Unexpected timing of the request on a reused connection %+v", timings[1])
+	}
+
+	timings = nil
+	p.TraceTiming = false
+	_, err := p.updateTxtValue(context.TODO(), account{ServerURL: srv.URL}, "value")
+	if err != nil || len(timings) != 0 {
+		t.Fatalf("Expected no timing when disabled, got %v, %v", timings, err)
+	}
+}